@@ -0,0 +1,37 @@
+package main
+
+// Bitfield records which pieces a peer has, one bit per piece with the high
+// bit of the first byte being piece 0, as in the bitfield message.
+type Bitfield []byte
+
+// newBitfield returns an empty bitfield large enough for pieces pieces.
+func newBitfield(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+// Has reports whether the piece at index is set.
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]>>(7-index%8)&1 == 1
+}
+
+// Set marks the piece at index as present.
+func (b Bitfield) Set(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	b[index/8] |= 1 << (7 - index%8)
+}
+
+// Count returns the number of pieces set.
+func (b Bitfield) Count() int {
+	n := 0
+	for _, bite := range b {
+		for ; bite != 0; bite &= bite - 1 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Choker settings, as in the reference BitTorrent client.
+const (
+	uploadSlots        = 4                // peers unchoked for their transfer rate
+	rechokeInterval    = 10 * time.Second // how often the regular slots are chosen
+	optimisticInterval = 30 * time.Second // how often the optimistic unchoke rotates
+)
+
+// chokePeer is a connection the choker decides to choke or unchoke.
+type chokePeer interface {
+	// Interested reports whether the peer wants our pieces.
+	Interested() bool
+	// Transferred returns the total bytes received from and sent to the peer.
+	Transferred() (downloaded, uploaded int64)
+	// Choked reports whether the peer is choked.
+	Choked() bool
+	// SetChoked chokes or unchokes the peer.
+	SetChoked(choked bool) error
+}
+
+// chokeChange is a choke or unchoke decided by choose, which is sent to the
+// peer once ch.mu is released.
+type chokeChange struct {
+	peer   chokePeer
+	choked bool
+}
+
+// choker implements the tit-for-tat choking algorithm. Every rechokeInterval
+// the interested peers with the best rates get the regular upload slots: the
+// peers we download fastest from, or those we upload fastest to once we are
+// seeding and download nothing. One more interested peer, chosen at random
+// and rotated every optimisticInterval, is unchoked optimistically so new
+// peers get a chance to prove themselves. Everyone else is choked.
+//
+// Only the incoming connections of the seed command are managed by a choker
+// so far. We never download over them, so they are always ranked by upload
+// rate; ranking by download rate is only used for peers reporting one.
+type choker struct {
+	mu         sync.Mutex
+	slots      int                       // number of regular unchoke slots
+	now        func() time.Time          // clock, replaced in tests
+	seeding    func() bool               // whether we have every piece
+	peers      map[chokePeer]*chokeStats // connected peers
+	optimistic chokePeer                 // optimistically unchoked peer, or nil
+	rotated    time.Time                 // when optimistic was chosen
+	rechoked   time.Time                 // when the rates were last measured
+	rand       *rand.Rand                // source for the optimistic unchoke
+}
+
+// chokeStats holds what the choker measured about a peer.
+type chokeStats struct {
+	downloaded, uploaded int64   // totals at the last rechoke
+	downRate, upRate     float64 // bytes per second since the rechoke before
+}
+
+// newChoker returns a choker with slots regular unchoke slots. seeding tells
+// it whether to rank peers by upload rather than download rate.
+func newChoker(slots int, seeding func() bool) *choker {
+	return &choker{
+		slots:    slots,
+		now:      time.Now,
+		seeding:  seeding,
+		peers:    map[chokePeer]*chokeStats{},
+		rechoked: time.Now(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add starts managing a new peer, which starts out choked.
+func (ch *choker) Add(p chokePeer) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.peers[p] = &chokeStats{}
+}
+
+// Remove stops managing a disconnected peer and gives its slot to another.
+func (ch *choker) Remove(p chokePeer) {
+	ch.mu.Lock()
+	delete(ch.peers, p)
+	if ch.optimistic == p {
+		ch.optimistic = nil
+	}
+	changes := ch.choose(false)
+	ch.mu.Unlock()
+
+	ch.apply(changes)
+}
+
+// Update fills free slots after a peer changed its interest, without waiting
+// for the next rechoke. Rates are not measured again.
+func (ch *choker) Update() {
+	ch.mu.Lock()
+	changes := ch.choose(false)
+	ch.mu.Unlock()
+
+	ch.apply(changes)
+}
+
+// Rechoke measures the rate of every peer since the last call and chooses
+// the peers to unchoke. The optimistic unchoke is rotated if it is due.
+func (ch *choker) Rechoke() {
+	ch.mu.Lock()
+	now := ch.now()
+	elapsed := now.Sub(ch.rechoked).Seconds()
+	ch.rechoked = now
+	for p, s := range ch.peers {
+		down, up := p.Transferred()
+		if elapsed > 0 {
+			s.downRate = float64(down-s.downloaded) / elapsed
+			s.upRate = float64(up-s.uploaded) / elapsed
+		}
+		s.downloaded, s.uploaded = down, up
+	}
+
+	changes := ch.choose(now.Sub(ch.rotated) >= optimisticInterval)
+	ch.mu.Unlock()
+
+	ch.apply(changes)
+}
+
+// Run rechokes every rechokeInterval until done is closed.
+func (ch *choker) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ch.Rechoke()
+		}
+	}
+}
+
+// choose picks the regular and optimistic unchokes from the current rates
+// and returns the peers to choke or unchoke to match. A new optimistic
+// unchoke is chosen if rotate is set or the current one no longer qualifies.
+// ch.mu must be held.
+func (ch *choker) choose(rotate bool) []chokeChange {
+	interested := []chokePeer{}
+	for p := range ch.peers {
+		if p.Interested() {
+			interested = append(interested, p)
+		}
+	}
+
+	// Best rate first. Seeders upload only, so they rank by upload rate.
+	seeding := ch.seeding()
+	rate := func(p chokePeer) float64 {
+		if seeding {
+			return ch.peers[p].upRate
+		}
+		return ch.peers[p].downRate
+	}
+	ch.rand.Shuffle(len(interested), func(i, j int) {
+		interested[i], interested[j] = interested[j], interested[i]
+	})
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rate(interested[i]) > rate(interested[j])
+	})
+
+	unchoke := map[chokePeer]bool{}
+	n := ch.slots
+	if n > len(interested) {
+		n = len(interested)
+	}
+	for _, p := range interested[:n] {
+		unchoke[p] = true
+	}
+
+	// The optimistic unchoke goes to one of the remaining interested peers.
+	rest := interested[n:]
+	current := ch.optimistic
+	if current != nil && (unchoke[current] || !current.Interested()) {
+		current = nil
+	}
+	if current == nil || rotate {
+		candidates := []chokePeer{}
+		for _, p := range rest {
+			if p != current || len(rest) == 1 {
+				candidates = append(candidates, p)
+			}
+		}
+		current = nil
+		if len(candidates) > 0 {
+			current = candidates[ch.rand.Intn(len(candidates))]
+		}
+		ch.rotated = ch.now()
+	}
+	ch.optimistic = current
+	if current != nil {
+		unchoke[current] = true
+	}
+
+	changes := []chokeChange{}
+	for p := range ch.peers {
+		if choked := !unchoke[p]; choked != p.Choked() {
+			changes = append(changes, chokeChange{peer: p, choked: choked})
+		}
+	}
+	return changes
+}
+
+// apply sends the changes returned by choose. It runs without ch.mu, so a
+// peer slow to accept them does not hold up the choker. Changes from two
+// calls may cross; the next choice corrects that, as it compares with the
+// state each peer reports.
+func (ch *choker) apply(changes []chokeChange) {
+	for _, c := range changes {
+		if err := c.peer.SetChoked(c.choked); err != nil {
+			logger.Warning("Could not change choke state of peer: %v\n", err)
+		}
+	}
+}
@@ -1,38 +1,54 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"strings"
 
 	"github.com/jackpal/bencode-go"
 )
 
 type Client struct {
 	Announce      string      // URL of the announce server
+	AnnounceList  [][]string  `bencode:"announce-list"` // Tiers of tracker URLs (BEP 12)
 	Info          TorrentInfo // Torrent information
 	InfoHash      string      // SHA-1 hash of the TorrentInfo data
+	RawInfo       string      // Bencoded info dictionary as found in the torrent file
 	Peers         []string    // List of peer IP addresses
-	ConnectedPeer int         // Index of the currently connected peer (-1 means none)
 	PieceHashes   []string    // SHA-1 hashes of Pieces
-	Bitfield      Message     // Bitfield indicating pieces the client has
+	PipelineDepth int         // Block requests in flight per peer (0 means default)
+	Port          int         // Port to listen on for incoming peers (0 means default)
+	Have          Bitfield    // Pieces we have verified on disk
+	Preallocate   bool        // Fill output files with zeros up front instead of leaving them sparse
+	PeerID        string      // ID we present to peers and trackers (PeerID if empty)
+
+	Nodes [][]interface{} `bencode:"nodes"` // DHT nodes as [host, port] pairs (BEP 5)
+	DHT   *DHT            // DHT node to find peers with besides the trackers, may be nil
 }
 
 type TorrentInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Length      int        `bencode:"length,omitempty"` // single-file torrents only
+	Files       []FileInfo `bencode:"files,omitempty"`  // multi-file torrents only
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Private     int        `bencode:"private,omitempty"` // 1 restricts peers to the tracker's
 }
 
-// NewClient reads a torrent file and populates the a Client struct.
-func NewClient(path string) (Client, error) {
-	c := Client{
-		ConnectedPeer: -1,
-	}
+// IsPrivate reports whether peers may only be found through the trackers.
+func (info TorrentInfo) IsPrivate() bool {
+	return info.Private == 1
+}
+
+// LoadTorrent reads a torrent file and populates a Client struct with its
+// metainfo. No tracker is contacted; FindPeers does that.
+func LoadTorrent(path string) (Client, error) {
+	c := Client{}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -44,78 +60,88 @@ func NewClient(path string) (Client, error) {
 		return c, err
 	}
 
-	infoHash, err := hashInfo(c.Info)
+	// Hash the info dictionary exactly as it was encoded, so keys that
+	// TorrentInfo does not model are still part of the hash.
+	rawInfo, err := rawDictValue(string(data), "info")
 	if err != nil {
-		return c, err
+		return c, fmt.Errorf("error reading info dictionary: %v", err)
 	}
-	c.InfoHash = infoHash
-
-	c.PieceHashes = hashPieces(c.Info.Pieces)
+	c.InfoHash = hashInfo(rawInfo)
 
-	err = c.peerList()
+	err = c.loadInfo(rawInfo)
 	if err != nil {
 		return c, err
 	}
 
-	return c, nil
-}
-
-// Connect connects the client to the peer in Peers[peerIndex].
-func (c *Client) Connect(peerIndex int) (net.Conn, error) {
-	conn, err := net.Dial("tcp", c.Peers[peerIndex])
-	if err != nil {
-		return nil, err
-	}
-	c.ConnectedPeer = peerIndex
-	return conn, nil
-}
+	c.shuffleTiers()
 
-func (c *Client) Close(conn net.Conn) {
-	conn.Close()
-	c.ConnectedPeer = -1
+	return c, nil
 }
 
-func Handshake(conn io.ReadWriter, infoHash string) (Peer, error) {
-	// Create the handshake message.
-	message := newHandshakeMessage(infoHash)
-
+// Handshake sends our handshake for infoHash with our peer ID, reads the one
+// the peer sends back and checks that it is for the same torrent. It returns
+// errSelfConnection if the peer turns out to be us.
+func Handshake(conn io.ReadWriter, infoHash, peerID string) (Peer, error) {
 	logger.Debug("Sending handshake...")
-	n, err := conn.Write(message)
-	if err != nil {
+	if _, err := conn.Write(newHandshakeMessage(infoHash, peerID)); err != nil {
 		return Peer{}, err
 	}
 
-	// Wait for the response.
-	resp := make([]byte, n)
-	_, err = conn.Read(resp)
-	if err != nil {
-		if err != io.EOF {
-			return Peer{}, err
-		}
-	}
-
-	peer, err := parseHandshake(resp)
+	peer, err := readHandshake(conn)
 	if err != nil {
 		return peer, err
 	}
-	logger.Debug("Handshake returned from peer %x.\n", peer.PeerID)
+	if peer.InfoHash != infoHash {
+		return peer, fmt.Errorf("peer answered for torrent %x, expected %x", peer.InfoHash, infoHash)
+	}
+	if peer.PeerID == peerID {
+		return peer, errSelfConnection
+	}
+	logger.Debug("Handshake returned from peer %x (%s).\n", peer.PeerID, identifyClient(peer.PeerID))
 
 	return peer, nil
 }
 
+// loadInfo decodes the bencoded info dictionary into the client and derives
+// the piece hashes from it.
+func (c *Client) loadInfo(rawInfo string) error {
+	info := TorrentInfo{}
+	if err := bencode.Unmarshal(strings.NewReader(rawInfo), &info); err != nil {
+		return err
+	}
+	if err := info.validateFiles(); err != nil {
+		return err
+	}
+	if len(info.Pieces)%20 != 0 {
+		return fmt.Errorf("pieces length %d is not a multiple of 20", len(info.Pieces))
+	}
+
+	c.Info = info
+	c.RawInfo = rawInfo
+	c.PieceHashes = hashPieces(info.Pieces)
+	return nil
+}
+
 func (c *Client) PrintInfo() {
 	fmt.Printf("Tracker URL: %s\n", c.Announce)
-	fmt.Printf("Length: %d\n", c.Info.Length)
+	fmt.Printf("Length: %d\n", c.Info.TotalLength())
 	fmt.Printf("Info Hash: %s\n", infoHashHex(c.InfoHash))
 	fmt.Printf("Piece Length: %d\n", c.Info.PieceLength)
 	fmt.Println("Piece Hashes:")
 	for _, hash := range c.PieceHashes {
 		fmt.Println(hash)
 	}
+	if c.Info.IsMultiFile() {
+		fmt.Println("Files:")
+		for _, f := range c.Info.fileEntries() {
+			fmt.Printf("%s (%d bytes)\n", f.Path, f.Length)
+		}
+	}
 }
 
 func PrintHandshake(handshake Peer) {
 	fmt.Printf("Peer ID: %x\n", handshake.PeerID)
+	fmt.Printf("Peer Client: %s\n", identifyClient(handshake.PeerID))
 }
 
 // hashPieces generates a slice of hex strings representing the SHA-1 hash of
@@ -136,42 +162,118 @@ func infoHashHex(infoHash string) string {
 	return hex.EncodeToString([]byte(infoHash))
 }
 
-// hashInfo calculates the SHA-1 hash of the torrent info dictionary in binary
-// format and stores it in the InfoHash field of the Client struct.
-func hashInfo(info TorrentInfo) (string, error) {
-	h := sha1.New()
-	err := bencode.Marshal(h, info)
-	if err != nil {
-		return "", err
-	}
-	infoHash := string(h.Sum(nil))
-	return infoHash, nil
+// hashInfo calculates the SHA-1 hash of the bencoded torrent info dictionary
+// in binary format.
+func hashInfo(rawInfo string) string {
+	h := sha1.Sum([]byte(rawInfo))
+	return string(h[:])
 }
 
-func newHandshakeMessage(infoHash string) []byte {
-	protocolLength := byte(19)
-	protocol := []byte("BitTorrent protocol")
+// Handshake layout: the length of the protocol string, the protocol string,
+// 8 reserved bytes, the info hash and the peer ID.
+const (
+	protocolName    = "BitTorrent protocol"
+	handshakeLength = 1 + len(protocolName) + 8 + 20 + 20
+)
+
+// errSelfConnection is returned when a handshake shows we connected to
+// ourselves, for instance because a tracker listed our own address.
+var errSelfConnection = errors.New("connected to ourselves")
+
+// newHandshakeMessage returns our handshake for the torrent with the given
+// info hash. The reserved bytes advertise the Fast Extension and the
+// extension protocol, which we always support.
+func newHandshakeMessage(infoHash, peerID string) []byte {
 	reserved := make([]byte, 8)
+	reserved[fastReservedByte] |= fastReservedBit
+	reserved[extensionReservedByte] |= extensionReservedBit
 
-	message := append([]byte{protocolLength}, protocol...)
+	message := append([]byte{byte(len(protocolName))}, protocolName...)
 	message = append(message, reserved...)
 	message = append(message, []byte(infoHash)...)
-	message = append(message, []byte(PeerID)...)
+	message = append(message, []byte(peerID)...)
 
 	return message
 }
 
+// readHandshake reads a whole handshake from the peer. The protocol is checked
+// before the rest is read, so a peer speaking something else fails early.
+func readHandshake(conn io.Reader) (Peer, error) {
+	resp := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(conn, resp[:1]); err != nil {
+		return Peer{}, err
+	}
+	if int(resp[0]) != len(protocolName) {
+		return Peer{}, fmt.Errorf("unexpected protocol name length %d", resp[0])
+	}
+	if _, err := io.ReadFull(conn, resp[1:]); err != nil {
+		return Peer{}, err
+	}
+	return parseHandshake(resp)
+}
+
+// parseHandshake decodes a handshake and the capabilities its reserved bytes
+// advertise.
 func parseHandshake(resp []byte) (Peer, error) {
 	result := Peer{}
-	if len(resp) != 68 {
-		return result, fmt.Errorf("expect response length 68, got %d", len(resp))
+	if len(resp) != handshakeLength {
+		return result, fmt.Errorf("expect handshake length %d, got %d", handshakeLength, len(resp))
+	}
+	if int(resp[0]) != len(protocolName) {
+		return result, fmt.Errorf("unexpected protocol name length %d", resp[0])
 	}
 
-	// Byte 0 should be 19, the length of the following protocol string
 	result.Protocol = string(resp[1:20])  // 19 bytes
 	result.Reserved = resp[20:28]         // 8 bytes
 	result.InfoHash = string(resp[28:48]) // 20 bytes
 	result.PeerID = string(resp[48:])     // 20 bytes
+	if result.Protocol != protocolName {
+		return result, fmt.Errorf("unexpected protocol %q", result.Protocol)
+	}
+
+	// Both sides advertise the Fast Extension in the reserved bytes, and it is
+	// enabled when both do. We always do.
+	result.Fast = supportsFast(result.Reserved)
+	result.Extended = supportsExtensions(result.Reserved)
 
 	return result, nil
 }
+
+// peerID returns the ID we present to peers and trackers.
+func (c *Client) peerID() string {
+	if c.PeerID == "" {
+		return PeerID
+	}
+	return c.PeerID
+}
+
+// Peer IDs follow the Azureus convention: the client code and version between
+// dashes, then random bytes. peerIDEnv names the environment variable that
+// sets the ID instead.
+const (
+	peerIDPrefix = "-GO0001-"
+	peerIDEnv    = "MYBITTORRENT_PEER_ID"
+)
+
+// PeerID is the ID clients present to peers and trackers unless they set their
+// own. It is chosen at startup so that two instances in a swarm do not collide.
+var PeerID = newPeerID()
+
+// newPeerID returns our client prefix followed by random bytes.
+func newPeerID() string {
+	id := make([]byte, 20)
+	copy(id, peerIDPrefix)
+	if _, err := rand.Read(id[len(peerIDPrefix):]); err != nil {
+		logger.Error("Error generating peer ID: %v", err)
+	}
+	return string(id)
+}
+
+// setPeerID replaces PeerID with id, which must be 20 bytes long.
+func setPeerID(id string) error {
+	if len(id) != 20 {
+		return fmt.Errorf("peer ID %q is %d bytes long, expected 20", id, len(id))
+	}
+	PeerID = id
+	return nil
+}
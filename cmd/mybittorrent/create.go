@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Bounds for the automatically chosen piece length, and the number of pieces
+// it aims to stay under.
+const (
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+	targetPieceCount   = 1500
+)
+
+// Value of the "created by" key of the torrent files we create.
+const createdBy = "mybittorrent"
+
+// Metainfo is the top level dictionary of a torrent file.
+type Metainfo struct {
+	Announce     string      `bencode:"announce,omitempty"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	Comment      string      `bencode:"comment,omitempty"`
+	CreatedBy    string      `bencode:"created by,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"`
+	Info         TorrentInfo `bencode:"info"`
+}
+
+// CreateOptions describes a torrent file to create.
+type CreateOptions struct {
+	Path         string    // file or directory to share
+	Announce     []string  // tracker URLs, the first one is the primary tracker
+	Comment      string    // free-form comment
+	PieceLength  int       // piece length in bytes (0 picks one automatically)
+	Private      bool      // restrict peer discovery to the trackers
+	CreationDate time.Time // creation date (zero means now)
+}
+
+// CreateTorrent hashes the file or directory at opts.Path and returns the
+// metainfo of a torrent sharing it.
+func CreateTorrent(opts CreateOptions) (Metainfo, error) {
+	meta := Metainfo{}
+
+	stat, err := os.Stat(opts.Path)
+	if err != nil {
+		return meta, err
+	}
+
+	root := opts.Path
+	info := TorrentInfo{Name: filepath.Base(filepath.Clean(opts.Path))}
+	var files []fileEntry
+	if stat.IsDir() {
+		info.Files, err = listFiles(root)
+		if err != nil {
+			return meta, err
+		}
+		if len(info.Files) == 0 {
+			return meta, fmt.Errorf("directory %s has no files", root)
+		}
+		// Files are read relative to the directory itself.
+		for _, f := range info.Files {
+			files = append(files, fileEntry{Path: filepath.Join(f.Path...), Length: f.Length})
+		}
+	} else {
+		root = filepath.Dir(opts.Path)
+		info.Length = int(stat.Size())
+		files = []fileEntry{{Path: info.Name, Length: info.Length}}
+	}
+
+	if info.TotalLength() == 0 {
+		return meta, fmt.Errorf("nothing to share in %s", opts.Path)
+	}
+	if err := info.validateFiles(); err != nil {
+		return meta, err
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = autoPieceLength(info.TotalLength())
+	}
+	if info.PieceLength < 0 {
+		return meta, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	logger.Info("Hashing %d bytes in pieces of %d bytes...\n", info.TotalLength(), info.PieceLength)
+	info.Pieces, err = hashFiles(root, files, info.PieceLength)
+	if err != nil {
+		return meta, err
+	}
+
+	meta.Info = info
+	if len(opts.Announce) > 0 {
+		meta.Announce = opts.Announce[0]
+	}
+	if len(opts.Announce) > 1 {
+		// One tier per tracker, tried in the order given.
+		for _, tracker := range opts.Announce {
+			meta.AnnounceList = append(meta.AnnounceList, []string{tracker})
+		}
+	}
+	meta.Comment = opts.Comment
+	meta.CreatedBy = createdBy
+	meta.CreationDate = opts.CreationDate.Unix()
+	if opts.CreationDate.IsZero() {
+		meta.CreationDate = time.Now().Unix()
+	}
+
+	return meta, nil
+}
+
+// WriteTorrent writes the bencoded metainfo to w.
+func WriteTorrent(w io.Writer, meta Metainfo) error {
+	return bencode.Marshal(w, meta)
+}
+
+// autoPieceLength picks the smallest power of two piece length that keeps the
+// number of pieces under targetPieceCount.
+func autoPieceLength(totalLength int) int {
+	pieceLength := minAutoPieceLength
+	for pieceLength < maxAutoPieceLength && totalLength/pieceLength >= targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// listFiles returns the regular files under root in lexical order, with their
+// paths split into segments relative to root.
+func listFiles(root string) ([]FileInfo, error) {
+	files := []FileInfo{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{
+			Length: int(stat.Size()),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// hashFiles reads the files under root as one stream and returns the
+// concatenated SHA-1 hashes of its pieces.
+func hashFiles(root string, files []fileEntry, pieceLength int) (string, error) {
+	h := &pieceHasher{piece: make([]byte, 0, pieceLength)}
+
+	for _, f := range files {
+		in, err := os.Open(filepath.Join(root, f.Path))
+		if err != nil {
+			return "", err
+		}
+
+		n, err := io.Copy(h, in)
+		in.Close()
+		if err != nil {
+			return "", err
+		}
+		if int(n) != f.Length {
+			return "", fmt.Errorf("%s changed while hashing", f.Path)
+		}
+	}
+
+	return h.Sum(), nil
+}
+
+// pieceHasher splits the data written to it into pieces and hashes each one.
+type pieceHasher struct {
+	piece  []byte          // current partial piece, with the piece length as capacity
+	pieces strings.Builder // hashes of the full pieces so far
+}
+
+func (h *pieceHasher) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := copy(h.piece[len(h.piece):cap(h.piece)], p)
+		h.piece = h.piece[:len(h.piece)+n]
+		p = p[n:]
+		if len(h.piece) == cap(h.piece) {
+			h.pieces.WriteString(hashPiece(h.piece))
+			h.piece = h.piece[:0]
+		}
+	}
+	return total, nil
+}
+
+// Sum returns the hashes of every piece, including the last partial one.
+func (h *pieceHasher) Sum() string {
+	if len(h.piece) > 0 {
+		h.pieces.WriteString(hashPiece(h.piece))
+		h.piece = h.piece[:0]
+	}
+	return h.pieces.String()
+}
+
+// createTorrentFile creates the torrent described by opts and saves it to
+// outputPath.
+func createTorrentFile(opts CreateOptions, outputPath string) (Metainfo, error) {
+	meta, err := CreateTorrent(opts)
+	if err != nil {
+		return meta, err
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return meta, err
+	}
+	if err := WriteTorrent(out, meta); err != nil {
+		out.Close()
+		return meta, err
+	}
+
+	// Close reports write errors the file system deferred.
+	return meta, out.Close()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/jackpal/bencode-go"
@@ -26,6 +27,84 @@ func decodeTorrentFile(bencodedString string, out *Client) error {
 	return bencode.Unmarshal(reader, out)
 }
 
+// rawDictValue returns the bencoded value stored under key in the bencoded
+// dictionary data, exactly as it appears in data.
+func rawDictValue(data string, key string) (string, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return "", fmt.Errorf("expected a bencoded dictionary")
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		k, next, err := scanString(data, pos)
+		if err != nil {
+			return "", err
+		}
+		end, err := skipValue(data, next)
+		if err != nil {
+			return "", err
+		}
+		if k == key {
+			return data[next:end], nil
+		}
+		pos = end
+	}
+
+	return "", fmt.Errorf("key %q not found", key)
+}
+
+// skipValue returns the position just past the bencoded value starting at pos.
+func skipValue(data string, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("unexpected end of data at %d", pos)
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := strings.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer at %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := scanString(data, pos)
+		return end, err
+	default:
+		return 0, fmt.Errorf("invalid bencode type %q at %d", c, pos)
+	}
+}
+
+// scanString reads the bencoded string starting at pos and returns it along
+// with the position just past it.
+func scanString(data string, pos int) (string, int, error) {
+	colon := strings.IndexByte(data[pos:], ':')
+	if colon < 0 {
+		return "", 0, fmt.Errorf("invalid string at %d", pos)
+	}
+	length, err := strconv.Atoi(data[pos : pos+colon])
+	if err != nil || length < 0 {
+		return "", 0, fmt.Errorf("invalid string length at %d", pos)
+	}
+	start := pos + colon + 1
+	if start+length > len(data) {
+		return "", 0, fmt.Errorf("string at %d runs past end of data", pos)
+	}
+	return data[start : start+length], start + length, nil
+}
+
 func printDecodeOutput(decoded interface{}) {
 	jsonOutput, _ := json.Marshal(decoded)
 	fmt.Println(string(jsonOutput))
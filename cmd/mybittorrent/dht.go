@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// DHT settings.
+const (
+	dhtAlpha         = 3                // queries in flight during a lookup
+	dhtQueryTimeout  = 5 * time.Second  // how long to wait for a reply
+	dhtTokenLifetime = 5 * time.Minute  // how often the token secret changes
+	dhtPeerLifetime  = 30 * time.Minute // how long an announced peer is kept
+	dhtMaxPacketSize = 8192             // larger than any message we expect
+)
+
+// KRPC error codes (BEP 5).
+const (
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+// defaultDHTRouters are well-known nodes used to join the DHT when no other
+// node is known.
+var defaultDHTRouters = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// krpcMessage is a KRPC message as received: a query with its arguments, a
+// reply, or an error. Messages we send are built as maps so that only the
+// keys of their kind are present.
+type krpcMessage struct {
+	T string        `bencode:"t"` // transaction ID
+	Y string        `bencode:"y"` // q, r or e
+	Q string        `bencode:"q"` // method of a query
+	A krpcArgs      `bencode:"a"` // arguments of a query
+	R krpcReply     `bencode:"r"` // contents of a reply
+	E []interface{} `bencode:"e"` // error code and message
+}
+
+// krpcArgs are the arguments of a query.
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`       // find_node
+	InfoHash    string `bencode:"info_hash,omitempty"`    // get_peers and announce_peer
+	Port        int    `bencode:"port,omitempty"`         // announce_peer
+	ImpliedPort int    `bencode:"implied_port,omitempty"` // announce_peer: use the source port
+	Token       string `bencode:"token,omitempty"`        // announce_peer
+}
+
+// krpcReply is the contents of a reply.
+type krpcReply struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // compact node info
+	Values []string `bencode:"values,omitempty"` // compact peers
+	Token  string   `bencode:"token,omitempty"`  // allows an announce_peer
+}
+
+// DHT is a node of the mainline DHT (BEP 5). It finds peers for info hashes
+// without a tracker, and answers the queries of other nodes in the background
+// until it is closed.
+type DHT struct {
+	ID      string        // our 20-byte node ID
+	Routers []string      // nodes to join through when the routing table is empty
+	Timeout time.Duration // how long to wait for each reply
+
+	conn  *net.UDPConn
+	table *routingTable
+
+	mu         sync.Mutex
+	nextTID    uint16                          // transaction ID of the next query
+	pending    map[string]*dhtQuery            // queries awaiting a reply, by transaction ID
+	peers      map[string]map[string]time.Time // peers announced to us by info hash, with when
+	secret     []byte                          // current token secret
+	prevSecret []byte                          // previous token secret, still accepted
+	rotated    time.Time                       // when secret was chosen
+	closed     chan struct{}
+}
+
+// dhtQuery is a query sent to a node and waiting for its reply.
+type dhtQuery struct {
+	addr  string           // where the query was sent; replies must come from there
+	reply chan krpcMessage // receives the reply or error
+}
+
+// NewDHT starts a DHT node with a random ID listening on the UDP address addr.
+func NewDHT(addr string) (*DHT, error) {
+	return newDHT(addr, randomNodeID(), nil)
+}
+
+// LoadDHT starts a DHT node listening on the UDP address addr with the ID and
+// routing table saved to the state file at path by Save. If there is no state
+// file yet, the node starts with a random ID.
+func LoadDHT(addr, path string) (*DHT, error) {
+	state, err := readDHTState(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewDHT(addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read DHT state: %v", err)
+	}
+	if len(state.ID) != 20 {
+		return nil, fmt.Errorf("invalid node ID in DHT state")
+	}
+	return newDHT(addr, state.ID, parseCompactNodes(state.Nodes))
+}
+
+func newDHT(addr, id string, nodes []dhtNode) (*DHT, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DHT{
+		ID:      id,
+		Routers: defaultDHTRouters,
+		Timeout: dhtQueryTimeout,
+		conn:    conn,
+		table:   newRoutingTable(id),
+		pending: map[string]*dhtQuery{},
+		peers:   map[string]map[string]time.Time{},
+		closed:  make(chan struct{}),
+	}
+	for _, n := range nodes {
+		d.table.Seen(n.ID, n.Addr)
+	}
+	go d.readLoop()
+	return d, nil
+}
+
+// Addr returns the UDP address the node listens on.
+func (d *DHT) Addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+// Nodes returns the number of nodes in the routing table.
+func (d *DHT) Nodes() int {
+	return d.table.Len()
+}
+
+// Save writes the node ID and routing table to the state file at path.
+func (d *DHT) Save(path string) error {
+	return writeDHTState(path, dhtState{ID: d.ID, Nodes: compactNodes(d.table.Nodes())})
+}
+
+// Close stops the node.
+func (d *DHT) Close() error {
+	select {
+	case <-d.closed:
+		return net.ErrClosed
+	default:
+	}
+	close(d.closed)
+	return d.conn.Close()
+}
+
+// Bootstrap fills the routing table by looking up our own ID. If the table
+// has fewer than dhtK nodes, the lookup also starts from addrs, or from
+// d.Routers if addrs is empty. If none of the nodes known answers, as when
+// those from an old state file are gone, it starts over from addrs and
+// d.Routers. It fails if no node answers.
+func (d *DHT) Bootstrap(addrs []string) error {
+	start := addrs
+	if len(start) == 0 {
+		start = d.Routers
+	}
+	if d.table.Len() < dhtK {
+		d.ping(start)
+	}
+
+	replies := d.lookup(d.ID, "find_node")
+	if len(replies) == 0 {
+		logger.Debug("No known DHT node answered, joining through the routers.\n")
+		d.ping(append(append([]string{}, addrs...), d.Routers...))
+		replies = d.lookup(d.ID, "find_node")
+	}
+	if len(replies) == 0 {
+		return fmt.Errorf("no DHT node answered")
+	}
+	logger.Debug("DHT routing table has %d nodes.\n", d.table.Len())
+	return nil
+}
+
+// ping queries the nodes at addrs at the same time, so those that answer are
+// added to the routing table.
+func (d *DHT) ping(addrs []string) {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if _, err := d.query(addr, "ping", krpcArgs{}); err != nil {
+				logger.Debug("DHT node %s did not answer: %v\n", addr, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// GetPeers returns the peers the DHT knows for infoHash.
+func (d *DHT) GetPeers(infoHash string) ([]string, error) {
+	peers, _, err := d.getPeers(infoHash)
+	return peers, err
+}
+
+// Announce tells the nodes closest to infoHash that we accept peers on port,
+// and returns the peers they know for it.
+func (d *DHT) Announce(infoHash string, port int) ([]string, error) {
+	peers, closest, err := d.getPeers(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	announced := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, r := range closest {
+		wg.Add(1)
+		go func(r lookupReply) {
+			defer wg.Done()
+			args := krpcArgs{InfoHash: infoHash, Port: port, Token: r.token}
+			if _, err := d.query(r.node.Addr, "announce_peer", args); err != nil {
+				logger.Debug("DHT announce to %s failed: %v\n", r.node.Addr, err)
+				return
+			}
+			mu.Lock()
+			announced++
+			mu.Unlock()
+		}(r)
+	}
+	wg.Wait()
+	logger.Debug("Announced to %d DHT nodes.\n", announced)
+
+	return peers, nil
+}
+
+// getPeers runs a get_peers lookup for infoHash and returns the peers found
+// and the closest nodes that gave us a token.
+func (d *DHT) getPeers(infoHash string) ([]string, []lookupReply, error) {
+	if len(infoHash) != 20 {
+		return nil, nil, fmt.Errorf("invalid info hash length %d", len(infoHash))
+	}
+	if d.table.Len() == 0 {
+		return nil, nil, fmt.Errorf("no DHT nodes known")
+	}
+
+	replies := d.lookup(infoHash, "get_peers")
+	peers := []string{}
+	closest := []lookupReply{}
+	for _, r := range replies {
+		for _, v := range r.values {
+			peers = append(peers, parseCompactPeers(v)...)
+		}
+		if r.token != "" && len(closest) < dhtK {
+			closest = append(closest, r)
+		}
+	}
+	return uniquePeers(peers), closest, nil
+}
+
+// lookupReply is a reply to a query sent during a lookup.
+type lookupReply struct {
+	node   dhtNode  // node that answered
+	token  string   // token for announce_peer, get_peers only
+	values []string // compact peers, get_peers only
+}
+
+// lookup runs an iterative lookup of target with the find_node or get_peers
+// method: the closest nodes known are asked for nodes closer still, up to
+// dhtAlpha at a time, until the dhtK closest nodes found have all been asked.
+// It returns the replies, from the closest node first.
+func (d *DHT) lookup(target, method string) []lookupReply {
+	candidates := d.table.Closest(target, dhtK)
+	seen := map[string]bool{}
+	for _, n := range candidates {
+		seen[n.Addr] = true
+	}
+	queried := map[string]bool{}
+	replies := []lookupReply{}
+
+	for {
+		// Ask the closest candidates not asked yet.
+		sortByDistance(candidates, target)
+		batch := []dhtNode{}
+		for i := 0; i < len(candidates) && i < dhtK && len(batch) < dhtAlpha; i++ {
+			if !queried[candidates[i].Addr] {
+				batch = append(batch, candidates[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		failed := map[string]bool{}
+		for _, n := range batch {
+			queried[n.Addr] = true
+			wg.Add(1)
+			go func(n dhtNode) {
+				defer wg.Done()
+				args := krpcArgs{Target: target}
+				if method == "get_peers" {
+					args = krpcArgs{InfoHash: target}
+				}
+				r, err := d.query(n.Addr, method, args)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed[n.Addr] = true
+					return
+				}
+				n.ID = r.ID
+				replies = append(replies, lookupReply{node: n, token: r.Token, values: r.Values})
+				for _, found := range parseCompactNodes(r.Nodes) {
+					if !seen[found.Addr] && found.ID != d.ID {
+						seen[found.Addr] = true
+						candidates = append(candidates, found)
+					}
+				}
+			}(n)
+		}
+		wg.Wait()
+
+		// Nodes that did not answer make room for the next closest.
+		remaining := candidates[:0]
+		for _, n := range candidates {
+			if !failed[n.Addr] {
+				remaining = append(remaining, n)
+			}
+		}
+		candidates = remaining
+	}
+
+	sort.Slice(replies, func(i, j int) bool {
+		return distance(replies[i].node.ID, target) < distance(replies[j].node.ID, target)
+	})
+	return replies
+}
+
+// query sends a query to the node at addr and waits for its reply. Nodes that
+// answer are added to the routing table.
+func (d *DHT) query(addr, method string, args krpcArgs) (krpcReply, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return krpcReply{}, err
+	}
+	addr = udpAddr.String()
+
+	d.mu.Lock()
+	tid := string(binary.BigEndian.AppendUint16(nil, d.nextTID))
+	d.nextTID++
+	q := &dhtQuery{addr: addr, reply: make(chan krpcMessage, 1)}
+	d.pending[tid] = q
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+	}()
+
+	args.ID = d.ID
+	msg := map[string]interface{}{"t": tid, "y": "q", "q": method, "a": args}
+	if err := d.send(udpAddr, msg); err != nil {
+		return krpcReply{}, err
+	}
+
+	timeout := time.NewTimer(d.Timeout)
+	defer timeout.Stop()
+	select {
+	case reply := <-q.reply:
+		if reply.Y == "e" {
+			return krpcReply{}, fmt.Errorf("DHT node %s returned error %v", addr, reply.E)
+		}
+		if len(reply.R.ID) != 20 {
+			return krpcReply{}, fmt.Errorf("DHT node %s sent an invalid node ID", addr)
+		}
+		d.table.Seen(reply.R.ID, addr)
+		return reply.R, nil
+	case <-timeout.C:
+		d.table.Failed(addr)
+		return krpcReply{}, fmt.Errorf("DHT node %s timed out", addr)
+	case <-d.closed:
+		return krpcReply{}, net.ErrClosed
+	}
+}
+
+// send bencodes a message and sends it to addr.
+func (d *DHT) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := bencode.Marshal(buf, msg); err != nil {
+		return err
+	}
+	_, err := d.conn.WriteToUDP(buf.Bytes(), addr)
+	return err
+}
+
+// readLoop answers queries and delivers replies until the node is closed.
+func (d *DHT) readLoop() {
+	buf := make([]byte, dhtMaxPacketSize)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+			}
+			logger.Debug("DHT read failed: %v\n", err)
+			continue
+		}
+
+		msg := krpcMessage{}
+		if err := bencode.Unmarshal(bytes.NewReader(buf[:n]), &msg); err != nil {
+			logger.Debug("Invalid DHT message from %s: %v\n", from, err)
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg, from)
+		case "r", "e":
+			d.mu.Lock()
+			q, ok := d.pending[msg.T]
+			d.mu.Unlock()
+			if ok && q.addr == from.String() {
+				select {
+				case q.reply <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// handleQuery answers a query from the node at from.
+func (d *DHT) handleQuery(msg krpcMessage, from *net.UDPAddr) {
+	reply, code, err := d.answer(msg, from)
+	if err != nil {
+		logger.Debug("Rejecting DHT %s query from %s: %v\n", msg.Q, from, err)
+		e := map[string]interface{}{"t": msg.T, "y": "e", "e": []interface{}{code, err.Error()}}
+		_ = d.send(from, e)
+		return
+	}
+	d.table.Seen(msg.A.ID, from.String())
+	reply.ID = d.ID
+	_ = d.send(from, map[string]interface{}{"t": msg.T, "y": "r", "r": reply})
+}
+
+// answer returns the reply to a query, or the KRPC error code and message to
+// send back instead.
+func (d *DHT) answer(msg krpcMessage, from *net.UDPAddr) (krpcReply, int, error) {
+	if len(msg.A.ID) != 20 {
+		return krpcReply{}, krpcProtocolError, fmt.Errorf("invalid node ID")
+	}
+
+	switch msg.Q {
+	case "ping":
+		return krpcReply{}, 0, nil
+	case "find_node":
+		if len(msg.A.Target) != 20 {
+			return krpcReply{}, krpcProtocolError, fmt.Errorf("invalid target")
+		}
+		return krpcReply{Nodes: compactNodes(d.table.Closest(msg.A.Target, dhtK))}, 0, nil
+	case "get_peers":
+		if len(msg.A.InfoHash) != 20 {
+			return krpcReply{}, krpcProtocolError, fmt.Errorf("invalid info hash")
+		}
+		return krpcReply{
+			Nodes:  compactNodes(d.table.Closest(msg.A.InfoHash, dhtK)),
+			Values: d.announced(msg.A.InfoHash),
+			Token:  d.token(from.IP, false),
+		}, 0, nil
+	case "announce_peer":
+		if len(msg.A.InfoHash) != 20 {
+			return krpcReply{}, krpcProtocolError, fmt.Errorf("invalid info hash")
+		}
+		if msg.A.Token == "" || (msg.A.Token != d.token(from.IP, false) && msg.A.Token != d.token(from.IP, true)) {
+			return krpcReply{}, krpcProtocolError, fmt.Errorf("bad token")
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = from.Port
+		}
+		if port <= 0 || port > 65535 {
+			return krpcReply{}, krpcProtocolError, fmt.Errorf("invalid port %d", port)
+		}
+		d.addPeer(msg.A.InfoHash, net.JoinHostPort(from.IP.String(), fmt.Sprint(port)))
+		return krpcReply{}, 0, nil
+	default:
+		return krpcReply{}, krpcMethodUnknown, fmt.Errorf("method unknown")
+	}
+}
+
+// addPeer stores a peer announced for infoHash.
+func (d *DHT) addPeer(infoHash, addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.peers[infoHash] == nil {
+		d.peers[infoHash] = map[string]time.Time{}
+	}
+	d.peers[infoHash][addr] = time.Now()
+}
+
+// announced returns the peers announced to us for infoHash in the last
+// dhtPeerLifetime, as compact peers.
+func (d *DHT) announced(infoHash string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	values := []string{}
+	for addr, when := range d.peers[infoHash] {
+		if time.Since(when) > dhtPeerLifetime {
+			delete(d.peers[infoHash], addr)
+			continue
+		}
+		if v4, _ := compactPeers([]string{addr}); v4 != "" {
+			values = append(values, v4)
+		}
+	}
+	return values
+}
+
+// token returns the token we give to the node at ip, made from the current
+// secret or the previous one. Secrets change every dhtTokenLifetime, so a
+// token stays valid for up to twice that.
+func (d *DHT) token(ip net.IP, previous bool) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.secret == nil || time.Since(d.rotated) > dhtTokenLifetime {
+		d.prevSecret = d.secret
+		d.secret = make([]byte, 16)
+		_, _ = rand.Read(d.secret)
+		d.rotated = time.Now()
+	}
+	secret := d.secret
+	if previous {
+		if d.prevSecret == nil {
+			return ""
+		}
+		secret = d.prevSecret
+	}
+	h := sha1.Sum(append(append([]byte{}, secret...), ip...))
+	return string(h[:])
+}
+
+// randomNodeID returns a random 20-byte node ID.
+func randomNodeID() string {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return string(id)
+}
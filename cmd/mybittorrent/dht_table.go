@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Routing table settings from BEP 5.
+const (
+	dhtK           = 8 // nodes per bucket, and nodes kept by a lookup
+	dhtMaxFailures = 2 // unanswered queries in a row before a node is dropped
+)
+
+// dhtNode is a node of the DHT we know about.
+type dhtNode struct {
+	ID       string    // 20-byte node ID
+	Addr     string    // ip_address:port of the node's UDP socket
+	seen     time.Time // last message received from the node
+	failures int       // queries in a row the node did not answer
+}
+
+// routingTable holds the nodes we know, in one bucket of up to dhtK nodes for
+// each length of the prefix their ID shares with ours. Most of the ID space
+// is far from us, so the nodes close to us are known best.
+type routingTable struct {
+	mu      sync.Mutex
+	self    string          // our node ID
+	buckets [160][]*dhtNode // bucket i holds the IDs sharing i leading bits with self
+}
+
+// newRoutingTable returns an empty routing table for the node with ID self.
+func newRoutingTable(self string) *routingTable {
+	return &routingTable{self: self}
+}
+
+// bucket returns the index of the bucket for id.
+func (t *routingTable) bucket(id string) int {
+	n := commonPrefixLen(t.self, id)
+	if n >= len(t.buckets) {
+		n = len(t.buckets) - 1
+	}
+	return n
+}
+
+// Seen records a message from the node id at addr. A new node is added if its
+// bucket has room or holds a node that stopped answering; otherwise the nodes
+// we already know are preferred, as they are likely to stay.
+func (t *routingTable) Seen(id, addr string) {
+	if len(id) != 20 || id == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.bucket(id)
+	for _, n := range t.buckets[i] {
+		if n.ID == id {
+			n.Addr = addr
+			n.seen = time.Now()
+			n.failures = 0
+			return
+		}
+	}
+
+	node := &dhtNode{ID: id, Addr: addr, seen: time.Now()}
+	if len(t.buckets[i]) < dhtK {
+		t.buckets[i] = append(t.buckets[i], node)
+		return
+	}
+	for j, n := range t.buckets[i] {
+		if n.failures > 0 {
+			t.buckets[i][j] = node
+			return
+		}
+	}
+}
+
+// Failed records that the node at addr did not answer a query, and drops it
+// after dhtMaxFailures in a row.
+func (t *routingTable) Failed(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, bucket := range t.buckets {
+		for j, n := range bucket {
+			if n.Addr != addr {
+				continue
+			}
+			n.failures++
+			if n.failures >= dhtMaxFailures {
+				t.buckets[i] = append(bucket[:j:j], bucket[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// Closest returns up to n known nodes closest to target, closest first.
+// Nodes that answered their last query come before those that did not.
+func (t *routingTable) Closest(target string, n int) []dhtNode {
+	nodes := t.Nodes()
+	sortByDistance(nodes, target)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].failures == 0 && nodes[j].failures > 0
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// Nodes returns every node in the table.
+func (t *routingTable) Nodes() []dhtNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := []dhtNode{}
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			nodes = append(nodes, *n)
+		}
+	}
+	return nodes
+}
+
+// Len returns the number of nodes in the table.
+func (t *routingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return 8 * len(a)
+}
+
+// distance returns the XOR distance between two node IDs.
+func distance(a, b string) string {
+	d := make([]byte, len(a))
+	for i := range d {
+		if i < len(b) {
+			d[i] = a[i] ^ b[i]
+		}
+	}
+	return string(d)
+}
+
+// sortByDistance sorts nodes by their distance to target, closest first.
+func sortByDistance(nodes []dhtNode, target string) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return distance(nodes[i].ID, target) < distance(nodes[j].ID, target)
+	})
+}
+
+// parseCompactNodes converts compact node info, 26 bytes per node: the node
+// ID followed by its compact IPv4 address.
+func parseCompactNodes(compact string) []dhtNode {
+	nodes := []dhtNode{}
+	for i := 0; i+26 <= len(compact); i += 26 {
+		addr := parseCompactPeers(compact[i+20 : i+26])[0]
+		nodes = append(nodes, dhtNode{ID: compact[i : i+20], Addr: addr})
+	}
+	return nodes
+}
+
+// compactNodes converts nodes into compact node info. Nodes with an IPv6
+// address have no compact form in BEP 5 and are left out.
+func compactNodes(nodes []dhtNode) string {
+	compact := strings.Builder{}
+	for _, n := range nodes {
+		if addr, _ := compactPeers([]string{n.Addr}); len(n.ID) == 20 && addr != "" {
+			compact.WriteString(n.ID)
+			compact.WriteString(addr)
+		}
+	}
+	return compact.String()
+}
+
+// dhtState is the bencoded content of the state file of a DHT node.
+type dhtState struct {
+	ID    string `bencode:"id"`    // node ID
+	Nodes string `bencode:"nodes"` // routing table in compact node info
+}
+
+// readDHTState reads the state file at path.
+func readDHTState(path string) (dhtState, error) {
+	state := dhtState{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	err = bencode.Unmarshal(bytes.NewReader(data), &state)
+	return state, err
+}
+
+// writeDHTState replaces the state file at path, creating its directory if
+// needed.
+func writeDHTState(path string, state dhtState) error {
+	data := &bytes.Buffer{}
+	if err := bencode.Marshal(data, state); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write a temporary file first so an interrupted save keeps the old state.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -4,236 +4,528 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"math"
-	"os"
+	"path/filepath"
+	"time"
 )
 
-func (c *Client) DownloadFile(conn io.ReadWriter, outputPath string) error {
-	// Handshake and run preliminary protocol.
-	err := c.initiateDownload(conn)
+// DownloadFile downloads every piece of the torrent from all available peers
+// and writes it at outputPath. For a single-file torrent outputPath is the
+// file to create. For a multi-file torrent it is the directory in which the
+// torrent's directory tree is created.
+func (c *Client) DownloadFile(outputPath string) error {
+	storage, err := c.NewStorage(storageFile, outputPath)
 	if err != nil {
 		return err
 	}
+	defer storage.Close()
 
-	// Download each piece into a separate file.
-	pieceFiles := []string{}
-	for i := 0; i < len(c.PieceHashes); i++ {
-		filename := fmt.Sprintf("%s.%d", outputPath, i)
-		pieceFiles = append(pieceFiles, filename)
+	if err := c.DownloadTo(storage); err != nil {
+		return err
+	}
+	logger.Info("Wrote %d bytes to %s.\n", c.Info.TotalLength(), outputPath)
+
+	return storage.Close()
+}
 
-		if err := c.DownloadPiece(conn, i, filename); err != nil {
-			return fmt.Errorf("error downloading piece %d: %v", i, err)
+// DownloadTo downloads the torrent into storage. Each piece is written at its
+// offset as soon as it is verified, so pieces can arrive in any order. Data
+// already in storage is hash-checked first, so an interrupted download
+// resumes with the missing pieces only.
+func (c *Client) DownloadTo(storage Storage) error {
+	c.Have = c.verifyPieces(storage)
+	missing := []int{}
+	for i := range c.PieceHashes {
+		if !c.Have.Has(i) {
+			missing = append(missing, i)
 		}
 	}
+	if c.Have.Count() > 0 {
+		logger.Info("Resuming download, %d/%d pieces already downloaded.\n",
+			c.Have.Count(), len(c.PieceHashes))
+	}
 
-	// Stitch the piece files together.
-	logger.Debug("Creating output file %s...\n", outputPath)
-	out, err := os.Create(outputPath)
+	err := c.downloadPieces(missing, func(index int, data []byte) error {
+		if err := c.writePiece(storage, index, data); err != nil {
+			return fmt.Errorf("error writing piece %d: %v", index, err)
+		}
+		c.Have.Set(index)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	for _, piece := range pieceFiles {
-		in, err := os.Open(piece)
-		if err != nil {
-			return err
-		}
-		defer in.Close()
+	return syncStorage(storage)
+}
 
-		logger.Debug("Copying contents of %s into output file...", piece)
-		n, err := io.Copy(out, in)
-		if err != nil {
-			return fmt.Errorf("error writing piece into file: %v", err)
-		}
-		logger.Info("Wrote %d bytes to %s.\n", n, outputPath)
+// outputFiles returns the directory the torrent's files are written to and the
+// files themselves, for a download to outputPath.
+func (c *Client) outputFiles(outputPath string) (string, []fileEntry) {
+	if c.Info.IsMultiFile() {
+		return outputPath, c.Info.fileEntries()
 	}
-
-	return nil
+	return filepath.Dir(outputPath), []fileEntry{{
+		Path:   filepath.Base(outputPath),
+		Length: c.Info.Length,
+	}}
 }
 
-func (c *Client) DownloadPiece(conn io.ReadWriter, pieceIndex int, outputPath string) error {
-	// Make sure client has the piece.
-	if !peerHasPiece(c.Bitfield, pieceIndex) {
-		return fmt.Errorf("peer does not have piece %d", pieceIndex)
+// DownloadPiece downloads a single piece from the available peers and saves
+// it to outputPath.
+func (c *Client) DownloadPiece(pieceIndex int, outputPath string) error {
+	if pieceIndex < 0 || pieceIndex >= len(c.PieceHashes) {
+		return fmt.Errorf("piece index %d out of range", pieceIndex)
 	}
 
-	// If last piece, calculate its size.
-	var pieceLength int
-	if pieceIndex == len(c.PieceHashes)-1 {
-		pieceLength = c.Info.Length % c.Info.PieceLength
-		logger.Debug("Last piece length %d", pieceLength)
-	} else {
-		pieceLength = c.Info.PieceLength
+	// The output file holds just the piece.
+	file := fileEntry{Path: filepath.Base(outputPath), Length: c.pieceLength(pieceIndex)}
+	storage, err := createFileStorage(filepath.Dir(outputPath), []fileEntry{file}, false)
+	if err != nil {
+		return err
 	}
+	defer storage.Close()
 
-	// Calculate how many blocks are needed to fetch the entire piece.
-	blocksRequired := int(math.Ceil(float64(pieceLength) / float64(blockLength)))
-
-	pieceBytesReceived := 0
-	piece := []byte{}
-
-	logger.Debug("Requesting %d blocks to retreive piece of length %d...\n",
-		blocksRequired, pieceLength)
-
-	// Download each block.
-	for blockNum := 1; blockNum <= blocksRequired; blockNum++ {
-		blockBytesExpected := blockLength
+	existing := make([]byte, file.Length)
+	if _, err := storage.ReadAt(existing, 0); err == nil && pieceIsValid(c.PieceHashes[pieceIndex], existing) {
+		logger.Info("Piece %d is already downloaded to %s.\n", pieceIndex, outputPath)
+		return nil
+	}
 
-		// Last block may be less than a full block length.
-		if blockNum == blocksRequired {
-			blockBytesExpected = pieceLength - pieceBytesReceived
-		}
+	err = c.downloadPieces([]int{pieceIndex}, func(index int, data []byte) error {
+		_, err := storage.WriteAt(data, 0)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-		block, err := downloadBlock(conn, pieceIndex, pieceBytesReceived, blockBytesExpected)
-		if err != nil {
-			return err
-		}
+	return storage.Close()
+}
 
-		if block != nil {
-			pieceBytesReceived += len(block)
-			logger.Info("Block %d/%d received %d bytes.\n", blockNum, blocksRequired, len(block))
-			piece = append(piece, block...)
-		} else {
-			logger.Error("Received empty block before reaching piece length.")
-			blockNum-- // try again
-		}
+// downloadPieces connects to every peer in c.Peers and downloads the pieces
+// with the given indices. A piece picker hands each peer the rarest piece it
+// has. Each verified piece is passed to save. A piece that fails on one peer
+// is put back in the picker so another peer can pick it up.
+func (c *Client) downloadPieces(indices []int, save func(index int, data []byte) error) error {
+	if len(indices) == 0 {
+		return nil
+	}
+	if len(c.Peers) == 0 {
+		return fmt.Errorf("no peers available")
 	}
 
-	logger.Info("Piece download complete, downloaded %d/%d bytes.\n", pieceBytesReceived, pieceLength)
-
-	if !pieceIsValid(c.PieceHashes[pieceIndex], piece) {
-		return fmt.Errorf("piece did not meet hash check")
+	picker := newPiecePicker(len(c.PieceHashes), indices)
+	total := picker.Remaining()
+	results := make(chan pieceResult)
+	done := make(chan struct{})
+	defer close(done)
+
+	// Peers found by peer exchange join those from the trackers while the
+	// download runs. A worker exits when its peer cannot be dialed or fails,
+	// and reports it on exited so that queued peers are dialed in its place.
+	// Once no peer is left connected or being dialed, and none is queued,
+	// nobody can finish the remaining pieces. Neither can they once every
+	// connected peer is idle, having none of them.
+	peers := newSwarm(c.Peers)
+	exited := make(chan string)
+	connect := func() {
+		for {
+			addr, ok := peers.Next()
+			if !ok {
+				return
+			}
+			go func() {
+				c.peerWorker(addr, picker, peers, results, done)
+				select {
+				case exited <- addr:
+				case <-done:
+				}
+			}()
+		}
 	}
-	logger.Info("Piece %d hash is valid.", pieceIndex)
+	connect()
 
-	err := savePiece(outputPath, piece)
-	if err != nil {
-		return err
+	for picker.Remaining() > 0 {
+		select {
+		case res := <-results:
+			if err := save(res.index, res.data); err != nil {
+				return err
+			}
+			picker.Done(res.index)
+			logger.Info("Piece %d saved, %d/%d pieces complete.\n",
+				res.index, total-picker.Remaining(), total)
+		case <-peers.Added():
+			connect()
+		case <-peers.Idled():
+			if peers.Stalled() {
+				return fmt.Errorf("no peer has any of the %d remaining pieces", picker.Remaining())
+			}
+		case addr := <-exited:
+			peers.Disconnected(addr)
+			connect()
+			if peers.Active() == 0 {
+				return fmt.Errorf("all peers disconnected with %d pieces remaining", picker.Remaining())
+			}
+			if peers.Stalled() {
+				return fmt.Errorf("no peer has any of the %d remaining pieces", picker.Remaining())
+			}
+		}
 	}
 
 	return nil
 }
 
-// savePiece saves a piece to disk.
-func savePiece(path string, piece []byte) error {
-	f, err := os.Create(path)
+// peerWorker connects to the peer at addr and downloads the pieces handed out
+// by picker until done is closed or the peer fails. Unless the torrent is
+// private, it exchanges the peers of the swarm with the peer.
+func (c *Client) peerWorker(addr string, picker *piecePicker, peers *swarm, results chan<- pieceResult, done <-chan struct{}) {
+	pc, err := c.dialPeer(addr)
 	if err != nil {
-		return err
+		logger.Warning("Could not start download from %s: %v\n", addr, err)
+		return
 	}
-	defer f.Close()
-
-	n, err := f.Write(piece)
-	if err != nil {
-		return err
+	defer pc.Close()
+	peers.Handshaken(addr)
+	connected := time.Now()
+
+	// Keep the picker up to date with the pieces the peer announces.
+	pc.onBitfield = picker.AddPeer
+	pc.onHave = picker.Have
+	defer picker.RemovePeer(pc.has)
+
+	pexHeard := false
+	if !c.Info.IsPrivate() {
+		pc.onPeers = func(added []pexPeer, dropped []string) {
+			pexHeard = true
+			// Peers that accepted someone's connection are tried first.
+			addrs := []string{}
+			for _, p := range added {
+				if p.flags&pexReachable != 0 {
+					addrs = append(addrs, p.addr)
+				}
+			}
+			for _, p := range added {
+				if p.flags&pexReachable == 0 {
+					addrs = append(addrs, p.addr)
+				}
+			}
+			if n := peers.Add(addr, addrs); n > 0 {
+				logger.Debug("Learned %d new peers from %s.\n", n, addr)
+			}
+			peers.Drop(addr, dropped)
+		}
 	}
 
-	if n != len(piece) {
-		return fmt.Errorf("only wrote %d bytes, piece length %d", n, len(piece))
+	for {
+		if !c.Info.IsPrivate() {
+			if err := pc.sendPex(peers.Connected()); err != nil {
+				logger.Warning("Could not exchange peers with %s: %v\n", addr, err)
+				return
+			}
+		}
+
+		// Ask to be unchoked only while the peer has pieces we need.
+		if err := pc.setInterested(picker.Interesting(pc.has)); err != nil {
+			logger.Warning("Could not send interest to %s: %v\n", addr, err)
+			return
+		}
+		// A peer with none of the pieces we need is idle once it has told
+		// us what it has and, unless the torrent is private, the peers it
+		// knows. Both are optional, so a peer that keeps quiet is idle
+		// after peerTimeout.
+		quiet := pc.handled == 0
+		if !c.Info.IsPrivate() && pc.extended {
+			quiet = quiet || pc.ext.M == nil || pc.ext.Supports("ut_pex") && !pexHeard
+		}
+		quiet = quiet && time.Since(connected) < peerTimeout
+		peers.SetIdle(addr, !pc.amInterested && !quiet)
+
+		changed := picker.Changed()
+		index, ok := 0, false
+		available := pc.available()
+		switch {
+		case !pc.amInterested:
+		case !pc.peerChoking:
+			// Pieces the peer suggests are likely in its cache.
+			index, ok = picker.PickFrom(pc.suggested, available)
+			if !ok {
+				index, ok = picker.Pick(available)
+			}
+		case len(pc.allowedFast) > 0:
+			index, ok = picker.PickFrom(pc.allowedFastPieces(), available)
+		}
+		if !ok {
+			// Wait until the peer unchokes us or a piece it has is put
+			// back, keeping track of its state meanwhile.
+			timeout := pc.unchokeTimeout()
+			var spoken <-chan time.Time
+			if !pc.amInterested && quiet {
+				spoken = time.After(time.Until(connected.Add(peerTimeout)))
+			}
+			select {
+			case <-done:
+				return
+			case <-changed:
+			case <-pc.pexDue():
+			case <-spoken:
+			case <-timeout:
+				logger.Warning("Peer %s did not unchoke us in %v.\n", addr, peerTimeout)
+				return
+			case msg, ok := <-pc.messages:
+				if !ok {
+					logger.Warning("Lost connection to %s: %v\n", addr, pc.err)
+					return
+				}
+				if err := pc.handle(msg); err != nil {
+					logger.Warning("Invalid message from %s: %v\n", addr, err)
+					return
+				}
+			}
+			continue
+		}
+
+		pw := pieceWork{
+			index:    index,
+			hash:     c.PieceHashes[index],
+			length:   c.pieceLength(index),
+			finished: picker.Finished(index),
+		}
+		data, err := c.downloadPiece(pc, pw)
+		switch {
+		case err == errPieceFinished:
+			logger.Debug("Piece %d was finished by another peer, cancelled on %s.\n", index, addr)
+			picker.Abort(index)
+			continue
+		case err == errRejected:
+			logger.Debug("Peer %s rejected piece %d.\n", addr, index)
+			pc.refused.Set(index)
+			picker.Abort(index)
+			continue
+		case err == errChoked:
+			logger.Debug("Peer %s kept us choked during piece %d.\n", addr, index)
+			picker.Abort(index)
+			continue
+		case err != nil:
+			logger.Warning("Piece %d failed on %s: %v\n", index, addr, err)
+			picker.Abort(index)
+			return
+		}
+		if !picker.Verified(index) {
+			continue // another peer delivered it first
+		}
+
+		select {
+		case results <- pieceResult{index: index, data: data}:
+		case <-done:
+			return
+		}
 	}
-	return nil
 }
 
-// pieceIsValid checks the hash of the piece received versus expected.
-func pieceIsValid(pieceHash string, pieceData []byte) bool {
-	h := sha1.New()
-
-	_, err := h.Write(pieceData)
-	if err != nil {
-		logger.Error("Error hashing piece: %v", err)
-		return false
+// pieceLength returns the length in bytes of the piece at index. Only the
+// last piece can be shorter than Info.PieceLength.
+func (c *Client) pieceLength(index int) int {
+	begin := index * c.Info.PieceLength
+	end := begin + c.Info.PieceLength
+	if total := c.Info.TotalLength(); end > total {
+		end = total
 	}
+	return end - begin
+}
 
-	hash := hex.EncodeToString(h.Sum(nil))
+// Errors returned by downloadPiece when the piece cannot be finished on the
+// connection, but the peer is still usable.
+var (
+	errPieceFinished = errors.New("piece finished by another peer")
+	errChoked        = errors.New("choked by peer for too long")
+	errRejected      = errors.New("request rejected by peer")
+)
 
-	return hash == pieceHash
+// isPeerUsable reports whether err, returned by downloadPiece, leaves the
+// peer usable.
+func isPeerUsable(err error) bool {
+	return err == errPieceFinished || err == errChoked || err == errRejected
 }
 
-func downloadBlock(conn io.ReadWriter, pieceIndex, offset, expectedLength int) ([]byte, error) {
-	// Build request message.
-	payload := requestPayloadToBytes(RequestPayload{
-		Index:  uint32(pieceIndex),
-		Offset: uint32(offset),
-		Length: uint32(expectedLength),
-	})
-	request := Message{
-		Header:  MessageHeader{Type: msgRequest},
-		Payload: payload,
+// downloadPiece downloads one piece from the peer and checks it against its
+// hash. Up to c.PipelineDepth block requests are kept in flight at once, and
+// each piece message is matched back to its request. Any other message the
+// peer sends meanwhile updates its state. While the peer chokes us no
+// requests are sent, unless the piece is in its allowed fast set, and the ones
+// it dropped or rejected are sent again once it unchokes us; if that takes
+// longer than peerTimeout, errChoked is returned. A request rejected while
+// the peer unchokes us returns errRejected. If pw.finished is closed before
+// the piece is complete, errPieceFinished is returned. Whatever the error, the
+// requests still in flight are cancelled, so their blocks are not mistaken
+// for answers to later requests.
+func (c *Client) downloadPiece(pc *peerConn, pw pieceWork) (data []byte, err error) {
+	// Make sure the peer has the piece.
+	if !pc.has.Has(pw.index) {
+		return nil, fmt.Errorf("peer does not have piece %d", pw.index)
 	}
 
-	// Send request message.
-	logger.Debug("Sending request message at offset %d...\n", offset)
-	err := sendMessage(conn, request)
-	if err != nil {
-		return nil, err
+	defer func() {
+		if err == nil {
+			return
+		}
+		// A peer we cannot cancel on is no longer usable.
+		if cerr := pc.cancelPending(); cerr != nil && isPeerUsable(err) {
+			err = cerr
+		}
+	}()
+
+	piece := make([]byte, pw.length)
+	todo := []blockRequest{} // blocks still to request, in order
+	for offset := 0; offset < pw.length; offset += blockLength {
+		length := blockLength
+		if pw.length-offset < length {
+			length = pw.length - offset // last block may be short
+		}
+		todo = append(todo, blockRequest{index: pw.index, offset: offset, length: length})
+	}
+	downloaded := 0 // bytes received so far
+	depth := c.pipelineDepth()
+	if pc.ext.Reqq > 0 && pc.ext.Reqq < depth {
+		depth = pc.ext.Reqq // more would be dropped by the peer
 	}
+	timeout := time.NewTimer(peerTimeout)
+	defer timeout.Stop()
+	var unchokeTimeout <-chan time.Time // set while the peer chokes us
+
+	logger.Debug("Requesting piece %d of length %d with %d requests in flight...\n",
+		pw.index, pw.length, depth)
+
+	for downloaded < pw.length {
+		// Keep the pipeline full.
+		allowed := !pc.peerChoking || pc.allowedFast[pw.index]
+		for allowed && len(pc.pending) < depth && len(todo) > 0 {
+			if err := pc.request(todo[0]); err != nil {
+				return nil, err
+			}
+			todo = todo[1:]
+		}
 
-	// Get piece message.
-	logger.Debug("Waiting for piece message...")
-	piece, err := receiveMessage(conn, msgPiece)
-	if err != nil {
-		if piece.Header.Type == msgRejected {
-			logger.Error("Request was rejected.")
+		var msg interface{}
+		select {
+		case <-pw.finished:
+			return nil, errPieceFinished
+		case <-timeout.C:
+			return nil, fmt.Errorf("no message received in %v", peerTimeout)
+		case <-unchokeTimeout:
+			return nil, errChoked
+		case m, ok := <-pc.messages:
+			if !ok {
+				return nil, pc.err
+			}
+			msg = m
+		}
+		if !timeout.Stop() {
+			<-timeout.C
+		}
+		timeout.Reset(peerTimeout)
+
+		if _, ok := msg.(chokeMsg); ok && !pc.fast {
+			// The peer drops our pending requests, so queue them again.
+			todo = append(pc.pendingRequests(), todo...)
+		}
+		rejected := false
+		if m, ok := msg.(rejectMsg); ok {
+			rejected = pc.pending[m.blockRequest]
+		}
+		if err := pc.handle(msg); err != nil {
+			return nil, err
+		}
+		switch m := msg.(type) {
+		case chokeMsg:
+			if unchokeTimeout == nil && !pc.allowedFast[pw.index] {
+				unchokeTimeout = time.After(peerTimeout)
+			}
+		case unchokeMsg:
+			unchokeTimeout = nil
+		case rejectMsg:
+			if !rejected {
+				continue
+			}
+			if !pc.peerChoking {
+				return nil, errRejected
+			}
+			// Requests pending when the peer choked us are rejected, ask
+			// again once it unchokes us.
+			todo = append([]blockRequest{m.blockRequest}, todo...)
+		case pieceMsg:
+			if !pc.received(m) {
+				logger.Warning("Ignoring unrequested block: index %d, offset %d.\n", m.index, m.offset)
+				continue
+			}
+			if m.index != pw.index {
+				logger.Debug("Ignoring late block: index %d, offset %d.\n", m.index, m.offset)
+				continue
+			}
+			copy(piece[m.offset:], m.block)
+			downloaded += len(m.block)
+			logger.Debug("Received %d/%d bytes of piece %d.\n", downloaded, pw.length, pw.index)
 		}
-		return nil, err
 	}
-	i, o, block := parsePiecePayload(piece)
-	logger.Debug("Piece message received: index %d, offset %d, block size %d.\n",
-		i, o, len(block))
 
-	return block, nil
+	if !pieceIsValid(pw.hash, piece) {
+		return nil, fmt.Errorf("piece %d did not meet hash check", pw.index)
+	}
+	logger.Debug("Piece %d hash is valid.", pw.index)
+
+	return piece, nil
 }
 
-func (c *Client) initiateDownload(conn io.ReadWriter) error {
-	// Execute handshake.
-	_, err := Handshake(conn, c.InfoHash)
-	if err != nil {
-		return err
+// pipelineDepth returns the number of block requests to keep in flight on
+// each connection.
+func (c *Client) pipelineDepth() int {
+	if c.PipelineDepth < 1 {
+		return defaultPipelineDepth
 	}
+	return c.PipelineDepth
+}
 
-	// Get bitfield message.
-	logger.Debug("Waiting for bitfield message...")
-	bitfield, err := receiveMessage(conn, msgBitfield)
-	if err != nil {
-		return err
-	}
-	logger.Debug("Bitfield message received: %+v\n", bitfield)
-	c.Bitfield = bitfield
+// pieceIsValid checks the hash of the piece received versus expected.
+func pieceIsValid(pieceHash string, pieceData []byte) bool {
+	hash := hex.EncodeToString([]byte(hashPiece(pieceData)))
 
-	logger.Debug("Sending interested message...")
-	interested := Message{
-		Header: MessageHeader{Type: msgInterested},
-	}
-	err = sendMessage(conn, interested)
-	if err != nil {
-		return err
-	}
+	return hash == pieceHash
+}
 
-	// Get 'unchoke' message
-	logger.Debug("Waiting for unchoke message...")
-	unchoke, err := receiveMessage(conn, msgUnchoke)
-	if err != nil {
-		return err
-	}
-	logger.Debug("Unchoke message received: %+v\n", unchoke)
+// hashPiece returns the SHA-1 hash of a piece in binary format, as it is
+// stored in the pieces string of the torrent info.
+func hashPiece(pieceData []byte) string {
+	h := sha1.Sum(pieceData)
+	return string(h[:])
+}
 
-	return nil
+// sendRequest asks the peer for the block of length bytes at offset within
+// the piece at pieceIndex.
+func sendRequest(conn io.Writer, pieceIndex, offset, length int) error {
+	logger.Debug("Sending request message for piece %d at offset %d...\n", pieceIndex, offset)
+	return sendBlockMessage(conn, msgRequest, pieceIndex, offset, length)
 }
 
-// peerHasPiece verifies whether the peer has the piece being requested.
-func peerHasPiece(bitfield Message, pieceIndex int) bool {
-	i := 0
-	for _, bite := range bitfield.Payload {
-		for j := 7; j >= 0; j-- {
-			if bite>>j&1 == 1 && i == pieceIndex {
-				return true
-			}
-			i++
-		}
-	}
-	return false
+// sendCancel withdraws an earlier request for a block.
+func sendCancel(conn io.Writer, pieceIndex, offset, length int) error {
+	logger.Debug("Sending cancel message for piece %d at offset %d...\n", pieceIndex, offset)
+	return sendBlockMessage(conn, msgCancel, pieceIndex, offset, length)
+}
+
+// sendBlockMessage sends a message of msgType whose payload identifies a
+// block, as used by request and cancel messages.
+func sendBlockMessage(conn io.Writer, msgType, pieceIndex, offset, length int) error {
+	payload := requestPayloadToBytes(RequestPayload{
+		Index:  uint32(pieceIndex),
+		Offset: uint32(offset),
+		Length: uint32(length),
+	})
+	return sendMessage(conn, Message{
+		Header:  MessageHeader{Type: msgType},
+		Payload: payload,
+	})
 }
 
 // requestPayloadToBytes converts RequestPayload data into a byte slice to
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Reserved byte and bit of the handshake advertising support for the
+// extension protocol (BEP 10).
+const (
+	extensionReservedByte = 5
+	extensionReservedBit  = 0x10
+)
+
+// Extended message IDs. The extended handshake always has ID 0, the others are
+// the IDs we assign to each extension in our extended handshake.
+const (
+	extHandshake  = 0
+	extUtMetadata = 1
+)
+
+// Client name and version sent in the v field of our extended handshake.
+const clientVersion = "mybittorrent 0.1"
+
+// Number of outstanding requests we accept from a peer, sent in the reqq field
+// of our extended handshake.
+const maxPeerRequests = 250
+
+// ExtendedHandshake is the bencoded payload of an extended handshake.
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`                       // extension name -> message ID, 0 disables it
+	V            string         `bencode:"v,omitempty"`             // client name and version
+	MetadataSize int            `bencode:"metadata_size,omitempty"` // size of the info dictionary
+	Reqq         int            `bencode:"reqq,omitempty"`          // outstanding requests the peer accepts
+}
+
+// Supports reports whether the handshake advertises the named extension.
+func (h ExtendedHandshake) Supports(name string) bool {
+	return h.M[name] != 0
+}
+
+// extension is a protocol extension negotiated in the extended handshake.
+// Each one is registered with registerExtension so that our extended
+// handshake advertises it and its messages reach its handler.
+type extension struct {
+	name string // key in the m dictionary, such as "ut_metadata"
+	id   int    // extended message ID we assign to it, above extHandshake
+
+	// handle processes a message of the extension received while
+	// downloading. It may be nil if the extension's messages are only
+	// exchanged outside the download, in which case they are ignored there.
+	handle func(pc *peerConn, payload []byte) error
+
+	// public extensions find peers beyond the trackers, so they are not
+	// offered for private torrents (BEP 27).
+	public bool
+}
+
+// extensions holds the registered extensions by the ID we assigned them.
+var extensions = map[int]extension{}
+
+// registerExtension adds an extension to those we support. It is called from
+// init functions and panics if the name or ID is already taken.
+func registerExtension(e extension) {
+	if e.id <= extHandshake || e.id > 255 {
+		panic(fmt.Sprintf("invalid extended message ID %d for %s", e.id, e.name))
+	}
+	for _, other := range extensions {
+		if other.name == e.name || other.id == e.id {
+			panic(fmt.Sprintf("extension %s registered twice", e.name))
+		}
+	}
+	extensions[e.id] = e
+}
+
+// ourExtendedHandshake returns the extended handshake we send, advertising
+// every registered extension, apart from the public ones for a private
+// torrent. metadataSize is the size of the info dictionary if we can serve it,
+// or 0.
+func ourExtendedHandshake(metadataSize int, private bool) ExtendedHandshake {
+	m := map[string]int{}
+	for id, e := range extensions {
+		if !(private && e.public) {
+			m[e.name] = id
+		}
+	}
+	return ExtendedHandshake{
+		M:            m,
+		V:            clientVersion,
+		MetadataSize: metadataSize,
+		Reqq:         maxPeerRequests,
+	}
+}
+
+// HandshakeExtended runs the BitTorrent handshake and, if the peer supports
+// the extension protocol, exchanges extended handshakes with it.
+func HandshakeExtended(conn io.ReadWriter, infoHash, peerID string, metadataSize int) (Peer, ExtendedHandshake, error) {
+	peer, err := Handshake(conn, infoHash, peerID)
+	if err != nil {
+		return peer, ExtendedHandshake{}, err
+	}
+	if !peer.Extended {
+		return peer, ExtendedHandshake{}, fmt.Errorf("peer does not support extensions")
+	}
+
+	logger.Debug("Sending extended handshake...")
+	if err := sendExtendedMessage(conn, extHandshake, ourExtendedHandshake(metadataSize, false)); err != nil {
+		return peer, ExtendedHandshake{}, err
+	}
+
+	logger.Debug("Waiting for extended handshake...")
+	payload, err := receiveExtended(conn, extHandshake)
+	if err != nil {
+		return peer, ExtendedHandshake{}, err
+	}
+	theirs, err := parseExtendedHandshake(payload)
+	if err != nil {
+		return peer, theirs, err
+	}
+	logger.Debug("Extended handshake received: %+v\n", theirs)
+
+	return peer, theirs, nil
+}
+
+// parseExtendedHandshake decodes the payload of an extended handshake.
+func parseExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	h := ExtendedHandshake{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload), &h); err != nil {
+		return h, fmt.Errorf("invalid extended handshake: %v", err)
+	}
+	return h, nil
+}
+
+// supportsExtensions reports whether the reserved bytes of a handshake
+// advertise the extension protocol.
+func supportsExtensions(reserved []byte) bool {
+	return len(reserved) == 8 &&
+		reserved[extensionReservedByte]&extensionReservedBit != 0
+}
+
+// sendExtendedMessage bencodes v and sends it as an extended message with the
+// given extended message ID, followed by any extra data.
+func sendExtendedMessage(conn io.Writer, id int, v interface{}, extra ...byte) error {
+	payload := bytes.NewBuffer([]byte{byte(id)})
+	if err := bencode.Marshal(payload, v); err != nil {
+		return err
+	}
+	payload.Write(extra)
+
+	return sendMessage(conn, Message{
+		Header:  MessageHeader{Type: msgExtended},
+		Payload: payload.Bytes(),
+	})
+}
+
+// receiveExtended reads messages from the peer until it receives an extended
+// message with the given ID, and returns its payload without the ID. Other
+// messages the peer sends in the meantime, such as its bitfield, are skipped.
+func receiveExtended(conn io.Reader, id int) ([]byte, error) {
+	for {
+		message, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if message.Header.Length == 0 || message.Header.Type != msgExtended {
+			logger.Debug("Skipping message of type %d while waiting for extended message.\n",
+				message.Header.Type)
+			continue
+		}
+		if len(message.Payload) == 0 {
+			return nil, fmt.Errorf("extended message without an ID")
+		}
+		if int(message.Payload[0]) != id {
+			logger.Debug("Skipping extended message %d.\n", message.Payload[0])
+			continue
+		}
+		return message.Payload[1:], nil
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// Bit of the reserved handshake bytes that advertises the Fast Extension
+// (BEP 6).
+const (
+	fastReservedByte = 7
+	fastReservedBit  = 0x04
+)
+
+// Number of pieces in the allowed fast set we give each peer.
+const allowedFastCount = 10
+
+// Number of suggested pieces remembered per peer.
+const maxSuggestedPieces = 16
+
+// supportsFast reports whether the reserved bytes of a handshake advertise
+// the Fast Extension.
+func supportsFast(reserved []byte) bool {
+	return len(reserved) == 8 &&
+		reserved[fastReservedByte]&fastReservedBit != 0
+}
+
+// allowedFastSet returns the k pieces of a torrent of pieces pieces that the
+// peer at ip may request from us even while choked, as specified in BEP 6.
+// The set only depends on the peer's /24 network and the torrent, so a peer
+// cannot get more pieces for free by reconnecting. Only IPv4 addresses are
+// covered by the specification; other addresses get no allowed fast set.
+func allowedFastSet(ip net.IP, infoHash string, pieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || pieces == 0 {
+		return nil
+	}
+	if k > pieces {
+		k = pieces
+	}
+
+	x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash...)
+	set := []int{}
+	seen := map[int]bool{}
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(pieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// FileInfo is an entry in the files list of a multi-file torrent.
+type FileInfo struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"` // path segments, the last one being the file name
+}
+
+// fileEntry is a file of the torrent along with its position in the
+// concatenated piece data.
+type fileEntry struct {
+	Path   string // path relative to the output directory
+	Length int    // length of the file in bytes
+	Offset int    // offset of the first byte of the file in the piece data
+}
+
+// IsMultiFile reports whether the torrent holds a directory of files rather
+// than a single file.
+func (info TorrentInfo) IsMultiFile() bool {
+	return len(info.Files) > 0
+}
+
+// TotalLength returns the length in bytes of all the data in the torrent.
+func (info TorrentInfo) TotalLength() int {
+	if !info.IsMultiFile() {
+		return info.Length
+	}
+	total := 0
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// fileEntries lists the files of the torrent in the order their data appears
+// in the pieces. A single-file torrent has one entry named after the torrent.
+// Paths of a multi-file torrent are placed under a directory named after it.
+func (info TorrentInfo) fileEntries() []fileEntry {
+	if !info.IsMultiFile() {
+		return []fileEntry{{Path: info.Name, Length: info.Length}}
+	}
+
+	entries := []fileEntry{}
+	offset := 0
+	for _, f := range info.Files {
+		path := filepath.Join(append([]string{info.Name}, f.Path...)...)
+		entries = append(entries, fileEntry{Path: path, Length: f.Length, Offset: offset})
+		offset += f.Length
+	}
+	return entries
+}
+
+// validateFiles makes sure the file list cannot write outside of the output
+// directory.
+func (info TorrentInfo) validateFiles() error {
+	if err := validatePathSegment(info.Name); err != nil {
+		return err
+	}
+	for _, f := range info.Files {
+		if len(f.Path) == 0 {
+			return fmt.Errorf("file entry has an empty path")
+		}
+		if f.Length < 0 {
+			return fmt.Errorf("file %q has negative length", strings.Join(f.Path, "/"))
+		}
+		for _, segment := range f.Path {
+			if err := validatePathSegment(segment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validatePathSegment(segment string) error {
+	if segment == "" || segment == "." || segment == ".." ||
+		strings.ContainsAny(segment, `/\`) {
+		return fmt.Errorf("invalid path segment %q in torrent", segment)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Magnet holds the parts of a magnet link we use.
+type Magnet struct {
+	InfoHash string   // SHA-1 hash of the info dictionary (20 bytes)
+	Name     string   // Display name, may be empty
+	Trackers []string // Tracker URLs
+	Peers    []string // Peer addresses given in the link
+}
+
+// ParseMagnet parses a magnet:?xt=urn:btih:... URI.
+func ParseMagnet(uri string) (Magnet, error) {
+	m := Magnet{}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return m, err
+	}
+	if u.Scheme != "magnet" {
+		return m, fmt.Errorf("not a magnet link: %q", uri)
+	}
+
+	values := u.Query()
+	for _, xt := range values["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		m.InfoHash, err = decodeInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return m, err
+		}
+	}
+	if m.InfoHash == "" {
+		return m, fmt.Errorf("magnet link has no urn:btih info hash")
+	}
+
+	m.Name = values.Get("dn")
+	m.Trackers = values["tr"]
+	m.Peers = values["x.pe"]
+
+	return m, nil
+}
+
+// decodeInfoHash decodes an info hash given in hex (40 characters) or
+// base32 (32 characters).
+func decodeInfoHash(s string) (string, error) {
+	var hash []byte
+	var err error
+	switch len(s) {
+	case 40:
+		hash, err = hex.DecodeString(s)
+	case 32:
+		hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("info hash has length %d", len(s))
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid info hash %q: %v", s, err)
+	}
+	return string(hash), nil
+}
+
+// NewMagnetClient creates a Client from a magnet link and announces it to the
+// trackers the link lists. The client has no torrent info until FetchMetadata
+// is called.
+func NewMagnetClient(uri string) (Client, error) {
+	return newMagnetClient(uri, nil)
+}
+
+// newMagnetClient creates a Client from a magnet link and finds peers from
+// its trackers and, if dht is not nil, from the DHT.
+func newMagnetClient(uri string, dht *DHT) (Client, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return Client{}, err
+	}
+
+	c := Client{
+		InfoHash: m.InfoHash,
+		Info:     TorrentInfo{Name: m.Name},
+		DHT:      dht,
+	}
+
+	// Each tracker of a magnet link is its own tier, so the peers of every
+	// tracker that answers are merged.
+	for _, tracker := range m.Trackers {
+		c.AnnounceList = append(c.AnnounceList, []string{tracker})
+	}
+	if len(m.Trackers) > 0 {
+		c.Announce = m.Trackers[0]
+	}
+	if len(m.Trackers) > 0 || dht != nil {
+		if err := c.FindPeers(); err != nil {
+			logger.Warning("Could not find peers: %v\n", err)
+		}
+	}
+	c.Peers = uniquePeers(append(m.Peers, c.Peers...))
+
+	if len(c.Peers) == 0 {
+		return c, fmt.Errorf("no peers found for magnet link")
+	}
+
+	return c, nil
+}
+
+func (m Magnet) Print() {
+	for _, tracker := range m.Trackers {
+		fmt.Printf("Tracker URL: %s\n", tracker)
+	}
+	fmt.Printf("Info Hash: %s\n", infoHashHex(m.InfoHash))
+}
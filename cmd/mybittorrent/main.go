@@ -1,22 +1,33 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/logging"
 )
 
 const (
-	cmdDecode        = "decode"
-	cmdInfo          = "info"
-	cmdPeers         = "peers"
-	cmdHandshake     = "handshake"
-	cmdDownloadPiece = "download_piece"
-	cmdDownloadFile  = "download"
-	logLevel         = logging.LevelInfo
+	cmdDecode              = "decode"
+	cmdInfo                = "info"
+	cmdPeers               = "peers"
+	cmdHandshake           = "handshake"
+	cmdDownloadPiece       = "download_piece"
+	cmdDownloadFile        = "download"
+	cmdMagnetParse         = "magnet_parse"
+	cmdMagnetHandshake     = "magnet_handshake"
+	cmdMagnetInfo          = "magnet_info"
+	cmdMagnetDownloadPiece = "magnet_download_piece"
+	cmdMagnetDownloadFile  = "magnet_download"
+	cmdCreate              = "create"
+	cmdScrape              = "scrape"
+	cmdSeed                = "seed"
+	logLevel               = logging.LevelInfo
 )
 
 var logger = logging.New(logLevel)
@@ -28,6 +39,13 @@ func main() {
 	}
 	command := os.Args[1]
 
+	if id := os.Getenv(peerIDEnv); id != "" {
+		if err := setPeerID(id); err != nil {
+			fmt.Printf("Invalid %s: %v\n", peerIDEnv, err)
+			os.Exit(1)
+		}
+	}
+
 	switch command {
 	case cmdDecode:
 		doDecode()
@@ -41,6 +59,22 @@ func main() {
 		doDownloadPiece()
 	case cmdDownloadFile:
 		doDownloadFile()
+	case cmdMagnetParse:
+		doMagnetParse()
+	case cmdMagnetHandshake:
+		doMagnetHandshake()
+	case cmdMagnetInfo:
+		doMagnetInfo()
+	case cmdMagnetDownloadPiece:
+		doDownloadPiece()
+	case cmdMagnetDownloadFile:
+		doDownloadFile()
+	case cmdCreate:
+		doCreate()
+	case cmdScrape:
+		doScrape()
+	case cmdSeed:
+		doSeed()
 	default:
 		fmt.Printf("Unknown command %q\n", command)
 		os.Exit(1)
@@ -59,22 +93,44 @@ func doDecode() {
 
 func doInfo() {
 	path := os.Args[2]
-	tf, err := NewClient(path)
+	c, err := LoadTorrent(path)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	tf.PrintInfo()
+	c.PrintInfo()
 }
 
 func doPeers() {
 	path := os.Args[2]
-	tf, err := NewClient(path)
+	c, err := LoadTorrent(path)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	PrintPeers(tf.Peers)
+	if err := c.FindPeers(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	PrintPeers(c.Peers)
+}
+
+func doScrape() {
+	path := os.Args[2]
+	c, err := LoadTorrent(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	result, err := c.Scrape()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Seeders: %d\n", result.Seeders)
+	fmt.Printf("Leechers: %d\n", result.Leechers)
+	fmt.Printf("Completed: %d\n", result.Completed)
 }
 
 func doHandshake() {
@@ -83,12 +139,12 @@ func doHandshake() {
 		os.Exit(1)
 	}
 	path := os.Args[2]
-	c, err := NewClient(path)
+	c, err := LoadTorrent(path)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	peer := os.Args[3] // peer ip_address:port
+	peer := os.Args[3] // peer ip_address:port, so no announce is needed
 
 	logger.Info("Connecting to peer at %s...\n", peer)
 	conn, err := net.Dial("tcp", peer)
@@ -98,7 +154,7 @@ func doHandshake() {
 	}
 	defer conn.Close()
 
-	handshake, err := Handshake(conn, c.InfoHash)
+	handshake, err := Handshake(conn, c.InfoHash, c.peerID())
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -110,71 +166,286 @@ func doHandshake() {
 func doDownloadPiece() {
 	if len(os.Args) < 6 || os.Args[2] != "-o" {
 		fmt.Println("Syntax: mybittorrent download_piece -o " +
-			"[OUTPUT_PATH] [TORRENT_PATH] [PIECE_INDEX]")
+			"[OUTPUT_PATH] [TORRENT_PATH|MAGNET_LINK] [PIECE_INDEX]")
 		os.Exit(1)
 	}
 	outputPath := os.Args[3]
 	path := os.Args[4]
 	piece, _ := strconv.Atoi(os.Args[5])
 
-	c, err := NewClient(path)
+	c, err := loadClient(path, nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	logger.Info("Downloading piece %d from %s to %s\n", piece, path, outputPath)
+	if err := c.DownloadPiece(piece, outputPath); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Piece %d downloaded to %s.\n", piece, outputPath)
+}
+
+func doDownloadFile() {
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("Syntax: mybittorrent download -o [OUTPUT_PATH] " +
+			"[-storage file|mmap] [-prealloc] [-dht] [TORRENT_PATH|MAGNET_LINK]")
+		flags.PrintDefaults()
+	}
+	outputPath := flags.String("o", "", "file or directory to download to")
+	backend := flags.String("storage", storageFile, "storage backend: file or mmap")
+	prealloc := flags.Bool("prealloc", false, "allocate the whole output up front instead of sparse files")
+	dhtOpts := addDHTFlags(flags)
+	_ = flags.Parse(os.Args[2:])
+
+	if *outputPath == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := flags.Arg(0)
+
+	dht, err := dhtOpts.start(defaultPort)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	defer dhtOpts.stop(dht)
 
-	// TODO manage connections to multiple peers
-	conn, err := c.Connect(1)
+	c, err := loadClient(path, dht)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer c.Close(conn)
+	c.Preallocate = *prealloc
 
-	// Handshake and run preliminary protocol.
-	if err := c.initiateDownload(conn); err != nil {
+	storage, err := c.NewStorage(*backend, *outputPath)
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	defer storage.Close()
 
-	// Download piece.
-	logger.Info("Downloading piece %d from %s to %s\n", piece, path, outputPath)
-	if err := c.DownloadPiece(conn, piece, outputPath); err != nil {
+	logger.Info("Downloading %s from %s to %s...\n", c.Info.Name, path, *outputPath)
+	if err := c.DownloadTo(storage); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := storage.Close(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Piece %d downloaded to %s.\n", piece, outputPath)
+	fmt.Printf("Downloaded %s to %s.\n", c.Info.Name, *outputPath)
 }
 
-func doDownloadFile() {
-	if len(os.Args) < 5 || os.Args[2] != "-o" {
-		fmt.Println("Syntax: mybittorrent download -o " +
-			"[OUTPUT_PATH] [TORRENT_PATH]")
+func doMagnetParse() {
+	m, err := ParseMagnet(os.Args[2])
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	outputPath := os.Args[3]
-	path := os.Args[4]
+	m.Print()
+}
+
+func doMagnetHandshake() {
+	c, err := NewMagnetClient(os.Args[2])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	peer := c.Peers[0]
+
+	logger.Info("Connecting to peer at %s...\n", peer)
+	conn, err := net.Dial("tcp", peer)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	handshake, ext, err := HandshakeExtended(conn, c.InfoHash, c.peerID(), 0)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	PrintHandshake(handshake)
+	fmt.Printf("Peer Metadata Extension ID: %d\n", ext.M["ut_metadata"])
+}
+
+func doMagnetInfo() {
+	c, err := loadClient(os.Args[2], nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	c.PrintInfo()
+}
+
+// loadClient creates a client from a magnet link, fetching its metadata from
+// the peers, or from the path of a torrent file, and finds its peers. Peers
+// are also looked up on the DHT if dht is not nil.
+func loadClient(source string, dht *DHT) (Client, error) {
+	if !strings.HasPrefix(source, "magnet:") {
+		c, err := LoadTorrent(source)
+		if err != nil {
+			return c, err
+		}
+		c.DHT = dht
+		return c, c.FindPeers()
+	}
+
+	c, err := newMagnetClient(source, dht)
+	if err != nil {
+		return c, err
+	}
+	if err := c.FetchMetadata(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func doCreate() {
+	var announce stringList
+	opts := CreateOptions{}
+	flags := flag.NewFlagSet(cmdCreate, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("Syntax: mybittorrent create [-o OUTPUT_PATH] [-a ANNOUNCE_URL]... " +
+			"[-c COMMENT] [-l PIECE_LENGTH] [-private] [PATH]")
+		flags.PrintDefaults()
+	}
+	outputPath := flags.String("o", "", "path of the torrent file (default PATH.torrent)")
+	flags.Var(&announce, "a", "tracker announce URL, may be repeated")
+	flags.StringVar(&opts.Comment, "c", "", "comment")
+	flags.IntVar(&opts.PieceLength, "l", 0, "piece length in bytes (default chosen from the size)")
+	flags.BoolVar(&opts.Private, "private", false, "set the private flag")
+	_ = flags.Parse(os.Args[2:])
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	opts.Path = flags.Arg(0)
+	opts.Announce = announce
+	if *outputPath == "" {
+		*outputPath = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+
+	meta, err := createTorrentFile(opts, *outputPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Created %s with %d pieces of %d bytes.\n",
+		*outputPath, len(hashPieces(meta.Info.Pieces)), meta.Info.PieceLength)
+}
+
+func doSeed() {
+	flags := flag.NewFlagSet(cmdSeed, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("Syntax: mybittorrent seed [-p PORT] [-dht] [TORRENT_PATH] [DATA_PATH]")
+		flags.PrintDefaults()
+	}
+	port := flags.Int("p", defaultPort, "port to listen on")
+	dhtOpts := addDHTFlags(flags)
+	_ = flags.Parse(os.Args[2:])
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := flags.Arg(0)
+	dataPath := flags.Arg(1)
 
-	c, err := NewClient(path)
+	// The DHT node keeps answering queries while we seed.
+	dht, err := dhtOpts.start(*port)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	defer dhtOpts.stop(dht)
 
-	// TODO manage connections to multiple peers
-	conn, err := c.Connect(1)
+	// Seeding announces to the trackers once it listens for peers.
+	c, err := LoadTorrent(path)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer c.Close(conn)
+	c.DHT = dht
+	c.Port = *port
 
-	logger.Info("Downloading %s from %s to %s...\n", c.Info.Name, path, outputPath)
-	if err := c.DownloadFile(conn, outputPath); err != nil {
+	logger.Info("Seeding %s from %s...\n", c.Info.Name, dataPath)
+	if err := c.Seed(dataPath); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+}
+
+// dhtFlags are the command line flags that configure the DHT.
+type dhtFlags struct {
+	enabled *bool
+	state   *string
+	nodes   stringList
+}
+
+// addDHTFlags defines the DHT flags on flags.
+func addDHTFlags(flags *flag.FlagSet) *dhtFlags {
+	f := &dhtFlags{}
+	f.enabled = flags.Bool("dht", false, "also find peers on the DHT")
+	f.state = flags.String("dht-state", defaultDHTStatePath(), "file keeping the DHT routing table between runs")
+	flags.Var(&f.nodes, "dht-node", "host:port of a DHT node to join through, may be repeated")
+	return f
+}
+
+// start returns a DHT node listening on the UDP port, or nil if the DHT is
+// not enabled.
+func (f *dhtFlags) start(port int) (*DHT, error) {
+	if !*f.enabled {
+		return nil, nil
+	}
+	dht, err := LoadDHT(fmt.Sprintf(":%d", port), *f.state)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.nodes) > 0 {
+		dht.Routers = f.nodes
+	}
+	return dht, nil
+}
+
+// stop saves the routing table of a node returned by start and closes it.
+func (f *dhtFlags) stop(dht *DHT) {
+	if dht == nil {
+		return
+	}
+	if err := dht.Save(*f.state); err != nil {
+		logger.Warning("Could not save DHT state: %v\n", err)
+	}
+	dht.Close()
+}
+
+// defaultDHTStatePath returns where the DHT routing table is kept unless the
+// -dht-state flag says otherwise.
+func defaultDHTStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "dht.state"
+	}
+	return filepath.Join(dir, "mybittorrent", "dht.state")
+}
+
+// stringList is a flag that collects every value it is given.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-	fmt.Printf("Downloaded %s to %s.\n", c.Info.Name, outputPath)
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
@@ -31,9 +31,53 @@ type PiecePayload struct {
 	Block  []byte  // data for the piece
 }
 
+// blockRequest identifies a block of a piece, as carried by request, cancel
+// and reject messages.
+type blockRequest struct {
+	index  int // piece index
+	offset int // byte offset within the piece
+	length int // length of the block
+}
+
+// Decoded peer messages. decodeMessage turns every message read from a peer
+// into one of these.
+type (
+	keepAliveMsg     struct{}
+	chokeMsg         struct{}
+	unchokeMsg       struct{}
+	interestedMsg    struct{}
+	notInterestedMsg struct{}
+	haveMsg          struct{ index int }
+	haveAllMsg       struct{}
+	haveNoneMsg      struct{}
+	suggestMsg       struct{ index int }
+	allowedFastMsg   struct{ index int }
+	bitfieldMsg      struct{ bitfield Bitfield }
+	requestMsg       struct{ blockRequest }
+	cancelMsg        struct{ blockRequest }
+	rejectMsg        struct{ blockRequest }
+	pieceMsg         struct {
+		index  int    // piece index
+		offset int    // byte offset within the piece
+		block  []byte // data of the block
+	}
+	extendedMsg struct {
+		id      int    // extended message ID
+		payload []byte // payload after the ID
+	}
+	unknownMsg struct {
+		msgType int    // message type we do not support
+		payload []byte // raw payload
+	}
+)
+
 // Length in bytes of the block size we are using in this app.
 const blockLength = 16 * 1024 // 16kb
 
+// Number of block requests kept in flight per connection unless the client
+// sets PipelineDepth.
+const defaultPipelineDepth = 5
+
 // Peer message types
 const (
 	msgChoke         = iota // 0 no payload
@@ -45,26 +89,39 @@ const (
 	msgRequest              // 6 index, offest, and length
 	msgPiece                // 7 index, offest, and piece index
 	msgCancel               // 8 index, offest, and length
-	msgRejected      = 16   // 16 request rejected by peer
+	msgSuggest       = 13   // 13 index worth downloading (BEP 6)
+	msgHaveAll       = 14   // 14 has every piece (BEP 6)
+	msgHaveNone      = 15   // 15 has no pieces (BEP 6)
+	msgRejected      = 16   // 16 request rejected by peer (BEP 6)
+	msgAllowedFast   = 17   // 17 index we may request while choked (BEP 6)
+	msgExtended      = 20   // 20 extension protocol message (BEP 10)
 )
 
-// receiveMessage reads a BitTorrent protocol response from the peer and
-// returns its contents and an error.
-func receiveMessage(conn io.ReadWriter, expectedType int) (Message, error) {
+// Longest message accepted from a peer: room for a piece message with the
+// largest block we serve, and for the bitfield of a torrent with up to 8
+// million pieces. A longer length prefix is taken as a broken or hostile peer
+// rather than allocated.
+const maxMessageLength = 1 << 20
+
+// readMessage reads the next message of any type from the peer. A keep-alive
+// is returned as a message with a Length of 0. Messages longer than
+// maxMessageLength are rejected before their payload is read.
+func readMessage(conn io.Reader) (Message, error) {
 	message := Message{}
 
 	// Get message length.
 	header := make([]byte, 4)
+	// A closed connection is reported as io.EOF rather than an empty message,
+	// which would be indistinguishable from a keep-alive.
 	if _, err := io.ReadFull(conn, header); err != nil {
-		if err != io.EOF {
-			return message, err
-		}
-		logger.Debug("Reached EOF while reading message header.")
-		return message, nil
+		return message, err
 	}
 
 	length := int(binary.BigEndian.Uint32(header))
 	message.Header.Length = length
+	if length > maxMessageLength {
+		return message, fmt.Errorf("message of %d bytes exceeds the limit of %d", length, maxMessageLength)
+	}
 	if length == 0 {
 		return message, nil
 	}
@@ -72,20 +129,9 @@ func receiveMessage(conn io.ReadWriter, expectedType int) (Message, error) {
 	// Get message type.
 	mt := make([]byte, 1)
 	if _, err := io.ReadFull(conn, mt); err != nil {
-		if err != io.EOF {
-			return message, err
-		}
-		logger.Debug("Reached EOF while reading message type.")
-		return message, nil
-	}
-
-	msgType := int(mt[0])
-	message.Header.Type = msgType
-
-	if msgType != expectedType {
-		return message,
-			fmt.Errorf("expected message type %d, received %d", expectedType, msgType)
+		return message, err
 	}
+	message.Header.Type = int(mt[0])
 
 	// Return now if there is no payload.
 	if length == 1 {
@@ -95,21 +141,93 @@ func receiveMessage(conn io.ReadWriter, expectedType int) (Message, error) {
 	// Get the payload.
 	payloadLength := length - 1 // Subtract the message type byte
 	payload := make([]byte, payloadLength)
-	_, err := io.ReadAtLeast(conn, payload, payloadLength)
-	if err != nil {
-		if err != io.EOF {
-			return message, err
-		}
-		logger.Debug("Reached EOF while reading message payload.")
-		return message, nil
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return message, err
 	}
 	message.Payload = payload
 
 	return message, nil
 }
 
+// decodeMessage checks the payload of a message read from a peer and returns
+// it as one of the typed messages. Message types we do not know are returned
+// as unknownMsg so the caller can ignore them.
+func decodeMessage(message Message) (interface{}, error) {
+	if message.Header.Length == 0 {
+		return keepAliveMsg{}, nil
+	}
+
+	payload := message.Payload
+	wantLength := func(n int) error {
+		if len(payload) != n {
+			return fmt.Errorf("message type %d has payload of %d bytes, expected %d",
+				message.Header.Type, len(payload), n)
+		}
+		return nil
+	}
+	block := func() blockRequest {
+		return blockRequest{
+			index:  int(binary.BigEndian.Uint32(payload[0:4])),
+			offset: int(binary.BigEndian.Uint32(payload[4:8])),
+			length: int(binary.BigEndian.Uint32(payload[8:12])),
+		}
+	}
+
+	switch message.Header.Type {
+	case msgChoke:
+		return chokeMsg{}, wantLength(0)
+	case msgUnchoke:
+		return unchokeMsg{}, wantLength(0)
+	case msgInterested:
+		return interestedMsg{}, wantLength(0)
+	case msgNotInterested:
+		return notInterestedMsg{}, wantLength(0)
+	case msgHave, msgSuggest, msgAllowedFast:
+		if err := wantLength(4); err != nil {
+			return nil, err
+		}
+		index := int(binary.BigEndian.Uint32(payload))
+		switch message.Header.Type {
+		case msgSuggest:
+			return suggestMsg{index: index}, nil
+		case msgAllowedFast:
+			return allowedFastMsg{index: index}, nil
+		}
+		return haveMsg{index: index}, nil
+	case msgHaveAll:
+		return haveAllMsg{}, wantLength(0)
+	case msgHaveNone:
+		return haveNoneMsg{}, wantLength(0)
+	case msgBitfield:
+		return bitfieldMsg{bitfield: Bitfield(payload)}, nil
+	case msgRequest, msgCancel, msgRejected:
+		if err := wantLength(12); err != nil {
+			return nil, err
+		}
+		switch message.Header.Type {
+		case msgRequest:
+			return requestMsg{block()}, nil
+		case msgCancel:
+			return cancelMsg{block()}, nil
+		}
+		return rejectMsg{block()}, nil
+	case msgPiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("piece message has payload of %d bytes", len(payload))
+		}
+		index, offset, data := parsePiecePayload(message)
+		return pieceMsg{index: int(index), offset: int(offset), block: data}, nil
+	case msgExtended:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("extended message without an ID")
+		}
+		return extendedMsg{id: int(payload[0]), payload: payload[1:]}, nil
+	}
+	return unknownMsg{msgType: message.Header.Type, payload: payload}, nil
+}
+
 // sendMessage sends a message to the peer.
-func sendMessage(conn io.ReadWriter, msg Message) error {
+func sendMessage(conn io.Writer, msg Message) error {
 	length := len(msg.Payload) + 1
 	msgType := byte(msg.Header.Type)
 	lengthPrefix := make([]byte, 4)
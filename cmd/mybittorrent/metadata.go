@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Length in bytes of each piece of metadata exchanged with ut_metadata (BEP 9).
+const metadataPieceLength = 16 * 1024
+
+// ut_metadata message types
+const (
+	metadataRequest = iota // 0 request a piece of the metadata
+	metadataData           // 1 piece of the metadata follows the dictionary
+	metadataReject         // 2 peer does not have the requested piece
+)
+
+func init() {
+	// Metadata is only fetched before downloading, outside the download's
+	// connections, but those connections serve it to peers that ask.
+	registerExtension(extension{name: "ut_metadata", id: extUtMetadata, handle: handleMetadata})
+}
+
+// MetadataMessage is the bencoded dictionary at the start of a ut_metadata
+// message.
+type MetadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// FetchMetadata downloads the info dictionary from the peers in c.Peers and
+// loads it into the client. The client must already know its InfoHash, as is
+// the case when it was created from a magnet link.
+func (c *Client) FetchMetadata() error {
+	for _, addr := range c.Peers {
+		rawInfo, err := c.fetchMetadataFrom(addr)
+		if err != nil {
+			logger.Warning("Could not fetch metadata from %s: %v\n", addr, err)
+			continue
+		}
+		logger.Info("Fetched metadata from %s.\n", addr)
+		return c.loadInfo(rawInfo)
+	}
+	return fmt.Errorf("could not fetch metadata from any peer")
+}
+
+// fetchMetadataFrom connects to the peer at addr and downloads the info
+// dictionary from it.
+func (c *Client) fetchMetadataFrom(addr string) (string, error) {
+	logger.Debug("Connecting to peer at %s for metadata...\n", addr)
+	conn, err := net.DialTimeout("tcp", addr, peerTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(peerTimeout)); err != nil {
+		return "", err
+	}
+
+	_, ext, err := HandshakeExtended(conn, c.InfoHash, c.peerID(), 0)
+	if err != nil {
+		return "", err
+	}
+
+	return downloadMetadata(conn, ext, c.InfoHash)
+}
+
+// downloadMetadata requests every piece of the metadata from a peer that has
+// completed the extended handshake, and checks the result against infoHash.
+func downloadMetadata(conn io.ReadWriter, ext ExtendedHandshake, infoHash string) (string, error) {
+	peerMetadataID := ext.M["ut_metadata"]
+	if !ext.Supports("ut_metadata") {
+		return "", fmt.Errorf("peer does not support ut_metadata")
+	}
+	if ext.MetadataSize <= 0 {
+		return "", fmt.Errorf("peer did not advertise the metadata size")
+	}
+
+	metadata := []byte{}
+	pieces := (ext.MetadataSize + metadataPieceLength - 1) / metadataPieceLength
+	for piece := 0; piece < pieces; piece++ {
+		logger.Debug("Requesting metadata piece %d/%d...\n", piece+1, pieces)
+		request := MetadataMessage{MsgType: metadataRequest, Piece: piece}
+		if err := sendExtendedMessage(conn, peerMetadataID, request); err != nil {
+			return "", err
+		}
+
+		// Replies are sent with the ID we assigned to ut_metadata.
+		payload, err := receiveExtended(conn, extUtMetadata)
+		if err != nil {
+			return "", err
+		}
+		msg, data, err := parseMetadataMessage(payload)
+		if err != nil {
+			return "", err
+		}
+		if msg.MsgType == metadataReject {
+			return "", fmt.Errorf("peer rejected metadata piece %d", piece)
+		}
+		if msg.MsgType != metadataData || msg.Piece != piece {
+			return "", fmt.Errorf("expected metadata piece %d, received type %d piece %d",
+				piece, msg.MsgType, msg.Piece)
+		}
+		metadata = append(metadata, data...)
+	}
+
+	if len(metadata) != ext.MetadataSize {
+		return "", fmt.Errorf("expected %d bytes of metadata, received %d",
+			ext.MetadataSize, len(metadata))
+	}
+	if hashInfo(string(metadata)) != infoHash {
+		return "", fmt.Errorf("metadata does not match the info hash")
+	}
+
+	return string(metadata), nil
+}
+
+// serveMetadata answers a ut_metadata message from a peer with the requested
+// piece of rawInfo, sent with the ID the peer assigned to ut_metadata. Requests
+// for pieces out of range are rejected; other message types are ignored.
+func serveMetadata(conn io.Writer, rawInfo string, peerMetadataID int, payload []byte) error {
+	req, _, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	if req.MsgType != metadataRequest {
+		return nil
+	}
+
+	begin := req.Piece * metadataPieceLength
+	if req.Piece < 0 || begin >= len(rawInfo) {
+		reject := MetadataMessage{MsgType: metadataReject, Piece: req.Piece}
+		return sendExtendedMessage(conn, peerMetadataID, reject)
+	}
+	end := begin + metadataPieceLength
+	if end > len(rawInfo) {
+		end = len(rawInfo)
+	}
+	logger.Debug("Sending metadata piece %d.\n", req.Piece)
+	reply := MetadataMessage{MsgType: metadataData, Piece: req.Piece, TotalSize: len(rawInfo)}
+	return sendExtendedMessage(conn, peerMetadataID, reply, []byte(rawInfo[begin:end])...)
+}
+
+// handleMetadata answers a ut_metadata request on a download connection with
+// the info dictionary, or a reject if we do not have it yet. Requests from
+// a peer that gave no ID to answer them with are ignored.
+func handleMetadata(pc *peerConn, payload []byte) error {
+	if !pc.ext.Supports("ut_metadata") {
+		logger.Debug("Ignoring ut_metadata message from %s.\n", pc.addr)
+		return nil
+	}
+	if err := pc.refreshWriteDeadline(); err != nil {
+		return err
+	}
+	return serveMetadata(pc.conn, pc.rawInfo, pc.ext.M["ut_metadata"], payload)
+}
+
+// parseMetadataMessage splits a ut_metadata payload into its dictionary and
+// the piece data that follows it.
+func parseMetadataMessage(payload []byte) (MetadataMessage, []byte, error) {
+	msg := MetadataMessage{}
+	end, err := skipValue(string(payload), 0)
+	if err != nil {
+		return msg, nil, fmt.Errorf("invalid ut_metadata message: %v", err)
+	}
+	if err := bencode.Unmarshal(bytes.NewReader(payload[:end]), &msg); err != nil {
+		return msg, nil, fmt.Errorf("invalid ut_metadata message: %v", err)
+	}
+	return msg, payload[end:], nil
+}
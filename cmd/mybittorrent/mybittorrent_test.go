@@ -2,9 +2,27 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/jackpal/bencode-go"
 )
 
 func TestDecode(t *testing.T) {
@@ -31,10 +49,53 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestRawDictValue(t *testing.T) {
+	tests := map[string]struct {
+		data    string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		"string value":      {"d3:foo3:bare", "foo", "3:bar", false},
+		"nested dictionary": {"d1:ai1e4:infod7:privatei1e4:name1:xee", "info", "d7:privatei1e4:name1:xe", false},
+		"list before key":   {"d1:ali1e2:abe4:infoi7ee", "info", "i7e", false},
+		"missing key":       {"d3:foo3:bare", "info", "", true},
+		"not a dictionary":  {"l3:fooe", "foo", "", true},
+		"truncated string":  {"d4:info5:abce", "info", "", true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := rawDictValue(test.data, test.key)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wanted error %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got %q, wanted %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("sample torrent info hash", func(t *testing.T) {
+		data, err := os.ReadFile("../../sample.torrent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := rawDictValue(string(data), "info")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := hex.EncodeToString([]byte(hashInfo(raw)))
+		if want := "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"; got != want {
+			t.Errorf("got %s, wanted %s", got, want)
+		}
+	})
+}
+
 func TestInfo(t *testing.T) {
-	c, err := NewClient("../../sample.torrent")
+	c, err := LoadTorrent("../../sample.torrent")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatal(err)
 	}
 
 	tests := map[string]struct {
@@ -63,9 +124,12 @@ func TestInfo(t *testing.T) {
 }
 
 func TestPeers(t *testing.T) {
-	c, err := NewClient("../../sample.torrent")
+	c, err := LoadTorrent("../../sample.torrent")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatal(err)
+	}
+	if err := c.FindPeers(); err != nil {
+		t.Error(err)
 	}
 
 	tests := map[string]struct {
@@ -89,24 +153,24 @@ func TestPeers(t *testing.T) {
 }
 
 func TestHandshake(t *testing.T) {
-	c, err := NewClient("../../sample.torrent")
+	c, err := LoadTorrent("../../sample.torrent")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatal(err)
 	}
 
 	// Put a handshake response in the read buffer.
-	buf := newHandshakeMessage(c.InfoHash)
+	buf := newHandshakeMessage(c.InfoHash, testPeerID)
 	conn := bytes.NewBuffer(buf)
 
 	tests := map[string]struct {
 		want string
 	}{
-		"handshake has correct peer ID": {PeerID},
+		"handshake has correct peer ID": {testPeerID},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			got, err := Handshake(conn, c.InfoHash)
+			got, err := Handshake(conn, c.InfoHash, PeerID)
 			if err != nil {
 				t.Errorf(err.Error())
 			}
@@ -118,7 +182,7 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
-func TestPeerHasPiece(t *testing.T) {
+func TestBitfieldHas(t *testing.T) {
 	tests := map[string]struct {
 		bitfield []byte
 		piece    int
@@ -133,10 +197,7 @@ func TestPeerHasPiece(t *testing.T) {
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			bitfield := Message{
-				Payload: test.bitfield,
-			}
-			got := peerHasPiece(bitfield, test.piece)
+			got := Bitfield(test.bitfield).Has(test.piece)
 			if got != test.want {
 				t.Errorf("got %t, wanted %t",
 					got, test.want)
@@ -145,4 +206,2580 @@ func TestPeerHasPiece(t *testing.T) {
 	}
 }
 
-func TestDownloadPiece(t *testing.T) {}
+func TestPieceLength(t *testing.T) {
+	c := Client{Info: TorrentInfo{Length: 92063, PieceLength: 32768}}
+
+	tests := map[string]struct {
+		index int
+		want  int
+	}{
+		"first piece":      {0, 32768},
+		"middle piece":     {1, 32768},
+		"short last piece": {2, 26527},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := c.pieceLength(test.index)
+			if got != test.want {
+				t.Errorf("got %d, wanted %d", got, test.want)
+			}
+		})
+	}
+
+	c.Info.Length = 65536
+	if got := c.pieceLength(1); got != 32768 {
+		t.Errorf("got %d for a full last piece, wanted 32768", got)
+	}
+}
+
+func TestDownloadPieces(t *testing.T) {
+	tests := map[string]struct {
+		peers []fakePeerMode
+	}{
+		"single peer":                 {[]fakePeerMode{fakeSeeder}},
+		"several peers":               {[]fakePeerMode{fakeSeeder, fakeSeeder, fakeSeeder}},
+		"retries after a broken peer": {[]fakePeerMode{fakeBroken, fakeSeeder}},
+		"skips a peer missing pieces": {[]fakePeerMode{fakeEmpty, fakeSeeder}},
+		"peer sending other messages": {[]fakePeerMode{fakeChatty}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, data := newTestClient(t, 100000, 16384)
+			for _, mode := range test.peers {
+				c.Peers = append(c.Peers, startFakePeer(t, &c, data, mode))
+			}
+
+			got := make([]byte, len(data))
+			err := c.downloadPieces([]int{0, 1, 2, 3, 4, 5, 6}, func(index int, piece []byte) error {
+				copy(got[index*c.Info.PieceLength:], piece)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded data does not match")
+			}
+		})
+	}
+}
+
+func TestDownloadPiecesNoSupplier(t *testing.T) {
+	c, data := newTestClient(t, 100000, 16384)
+	c.Peers = []string{startFakePeer(t, &c, data, fakeEmpty)}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.downloadPieces([]int{0, 1}, func(int, []byte) error { return nil })
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("got no error from a peer with no pieces")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download from a peer with no pieces did not return")
+	}
+}
+
+func TestDownloadPiecePipelined(t *testing.T) {
+	c, data := newTestClient(t, 3*blockLength+100, 4*blockLength)
+	offsets := []int{0, blockLength, 2 * blockLength, 3 * blockLength}
+
+	tests := map[string]struct {
+		depth int
+		order []int // order in which the peer answers, by block number
+	}{
+		"one request at a time": {1, []int{0, 1, 2, 3}},
+		"all blocks in flight":  {4, []int{0, 1, 2, 3}},
+		"answers out of order":  {4, []int{3, 1, 0, 2}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pc, peer, received := pipePeer(t, len(c.PieceHashes))
+
+			// The peer waits for a full pipeline before it answers, then
+			// answers each block once it has been requested, checking that no
+			// more than depth requests are ever in flight.
+			peerErr := make(chan error, 1)
+			go func() {
+				defer close(peerErr)
+				defer peer.Close()
+				outstanding := map[int]bool{}
+				// wait reads requests until done, then a little longer to
+				// catch any the client sends beyond its pipeline.
+				wait := func(done func() bool) error {
+					for {
+						timeout := time.Second
+						if done() {
+							timeout = 20 * time.Millisecond
+						}
+						select {
+						case msg := <-received:
+							if msg.Header.Type != msgRequest {
+								return fmt.Errorf("got message type %d, wanted a request", msg.Header.Type)
+							}
+							outstanding[int(binary.BigEndian.Uint32(msg.Payload[4:8]))/blockLength] = true
+							if len(outstanding) > test.depth {
+								return fmt.Errorf("%d requests in flight, wanted at most %d", len(outstanding), test.depth)
+							}
+						case <-time.After(timeout):
+							if done() {
+								return nil
+							}
+							return fmt.Errorf("%d requests in flight, waited for more", len(outstanding))
+						}
+					}
+				}
+
+				if err := wait(func() bool { return len(outstanding) == test.depth }); err != nil {
+					peerErr <- err
+					return
+				}
+				for _, n := range test.order {
+					if err := wait(func() bool { return outstanding[n] }); err != nil {
+						peerErr <- err
+						return
+					}
+					end := offsets[n] + blockLength
+					if end > len(data) {
+						end = len(data)
+					}
+					payload := requestPayloadToBytes(RequestPayload{Offset: uint32(offsets[n])})[:8]
+					payload = append(payload, data[offsets[n]:end]...)
+					delete(outstanding, n)
+					_ = sendMessage(peer, Message{Header: MessageHeader{Type: msgPiece}, Payload: payload})
+				}
+			}()
+
+			c.PipelineDepth = test.depth
+			pw := pieceWork{index: 0, hash: c.PieceHashes[0], length: len(data)}
+			got, err := c.downloadPiece(pc, pw)
+			if err := <-peerErr; err != nil {
+				t.Fatal(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded piece does not match")
+			}
+		})
+	}
+}
+
+func TestDownloadPieceCancelled(t *testing.T) {
+	c, data := newTestClient(t, 3*blockLength, 4*blockLength)
+	c.PipelineDepth = 2
+	pc, _, received := pipePeer(t, len(c.PieceHashes))
+
+	// The piece was finished by another peer while the requests were sent.
+	finished := make(chan struct{})
+	close(finished)
+	pw := pieceWork{index: 0, hash: c.PieceHashes[0], length: len(data), finished: finished}
+	if _, err := c.downloadPiece(pc, pw); err != errPieceFinished {
+		t.Fatalf("got error %v, wanted %v", err, errPieceFinished)
+	}
+
+	requests, cancels := map[uint32]bool{}, map[uint32]bool{}
+	for i := 0; i < 2*c.PipelineDepth; i++ {
+		msg := <-received
+		offset := binary.BigEndian.Uint32(msg.Payload[4:8])
+		switch msg.Header.Type {
+		case msgRequest:
+			requests[offset] = true
+		case msgCancel:
+			cancels[offset] = true
+		}
+	}
+	if !reflect.DeepEqual(cancels, requests) || len(requests) != c.PipelineDepth {
+		t.Errorf("sent requests for %v and cancels for %v", requests, cancels)
+	}
+}
+
+func TestPeerConnWriteDeadline(t *testing.T) {
+	pc, _, received := pipePeer(t, 1)
+
+	// A deadline from an earlier piece or the handshake has long passed.
+	if err := pc.conn.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r := blockRequest{index: 0, offset: 0, length: blockLength}
+	writes := map[string]func() error{
+		"request":        func() error { return pc.request(r) },
+		"cancel":         func() error { return pc.cancel(r) },
+		"not interested": func() error { return pc.setInterested(false) },
+	}
+	for name, write := range writes {
+		if err := write(); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		<-received
+	}
+}
+
+func TestUnchokeTimeout(t *testing.T) {
+	pc, _, received := pipePeer(t, 1)
+	pc.peerChoking = true
+
+	if pc.unchokeTimeout() == nil {
+		t.Fatal("no timeout while choked and interested")
+	}
+	since := pc.chokedSince
+	for _, msg := range []interface{}{haveMsg{index: 0}, keepAliveMsg{}, chokeMsg{}} {
+		if err := pc.handle(msg); err != nil {
+			t.Fatal(err)
+		}
+		if pc.unchokeTimeout(); pc.chokedSince != since {
+			t.Errorf("%#v restarted the wait for an unchoke", msg)
+		}
+	}
+
+	if err := pc.handle(unchokeMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if !pc.chokedSince.IsZero() || pc.unchokeTimeout() != nil {
+		t.Errorf("still waiting for an unchoke after one")
+	}
+
+	pc.peerChoking = true
+	pc.unchokeTimeout()
+	if err := pc.setInterested(false); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	if pc.unchokeTimeout() != nil {
+		t.Errorf("waiting for an unchoke while not interested")
+	}
+}
+
+func TestDownloadPieceChoked(t *testing.T) {
+	c, data := newTestClient(t, 4*blockLength, 4*blockLength)
+	c.PipelineDepth = 4
+	pc, peer, received := pipePeer(t, len(c.PieceHashes))
+
+	block := func(n int) Message {
+		payload := requestPayloadToBytes(RequestPayload{Offset: uint32(n * blockLength)})[:8]
+		payload = append(payload, data[n*blockLength:(n+1)*blockLength]...)
+		return Message{Header: MessageHeader{Type: msgPiece}, Payload: payload}
+	}
+
+	// The peer answers the first request, then chokes us and drops the
+	// others. Once it unchokes us it answers whatever is asked again.
+	again := make(chan []int, 1)
+	go func() {
+		for i := 0; i < 4; i++ {
+			<-received
+		}
+		_ = sendMessage(peer, block(0))
+		_ = sendMessage(peer, Message{Header: MessageHeader{Type: msgChoke}})
+		_ = sendMessage(peer, Message{Header: MessageHeader{Type: msgUnchoke}})
+		offsets := []int{}
+		for i := 0; i < 3; i++ {
+			msg := <-received
+			n := int(binary.BigEndian.Uint32(msg.Payload[4:8])) / blockLength
+			offsets = append(offsets, n)
+			_ = sendMessage(peer, block(n))
+		}
+		again <- offsets
+	}()
+
+	pw := pieceWork{index: 0, hash: c.PieceHashes[0], length: len(data)}
+	got, err := c.downloadPiece(pc, pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded piece does not match")
+	}
+	if offsets := <-again; !reflect.DeepEqual(offsets, []int{1, 2, 3}) {
+		t.Errorf("requested blocks %v again after the choke, wanted [1 2 3]", offsets)
+	}
+	if pc.peerChoking {
+		t.Errorf("peer still choking after unchoke")
+	}
+}
+
+func TestDownloadPieceFast(t *testing.T) {
+	c, data := newTestClient(t, 2*blockLength, 2*blockLength)
+	c.PipelineDepth = 2
+
+	// A choked peer serves a piece in our allowed fast set.
+	pc, peer, received := pipePeer(t, len(c.PieceHashes))
+	pc.fast = true
+	pc.peerChoking = true
+	pc.allowedFast[0] = true
+	go func() {
+		for i := 0; i < 2; i++ {
+			msg := <-received
+			payload := append(msg.Payload[:8:8], data[i*blockLength:(i+1)*blockLength]...)
+			_ = sendMessage(peer, Message{Header: MessageHeader{Type: msgPiece}, Payload: payload})
+		}
+	}()
+
+	pw := pieceWork{index: 0, hash: c.PieceHashes[0], length: len(data)}
+	got, err := c.downloadPiece(pc, pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded piece does not match")
+	}
+
+	// An unchoking peer that rejects a request will not send the piece.
+	pc, peer, received = pipePeer(t, len(c.PieceHashes))
+	pc.fast = true
+	go func() {
+		msg := <-received
+		_ = sendMessage(peer, Message{Header: MessageHeader{Type: msgRejected}, Payload: msg.Payload})
+	}()
+
+	if _, err := c.downloadPiece(pc, pw); err != errRejected {
+		t.Errorf("got error %v, wanted %v", err, errRejected)
+	}
+
+	// The other request is withdrawn, so its block is not taken for an
+	// answer to the next piece.
+	if len(pc.pending) != 0 {
+		t.Errorf("got %d requests pending after the rejection, wanted 0", len(pc.pending))
+	}
+	for _, want := range []int{msgRequest, msgCancel} {
+		select {
+		case msg := <-received:
+			if msg.Header.Type != want || binary.BigEndian.Uint32(msg.Payload[4:8]) != blockLength {
+				t.Errorf("got message %d for offset %d, wanted %d for offset %d",
+					msg.Header.Type, binary.BigEndian.Uint32(msg.Payload[4:8]), want, blockLength)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("peer did not receive message %d", want)
+		}
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	c, data := newTestClient(t, 100000, 16384)
+
+	// A peer that has every piece but never sends any of them.
+	cancelled := make(chan struct{}, len(c.PieceHashes))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hs := make([]byte, 68)
+		if _, err := io.ReadFull(conn, hs); err != nil {
+			return
+		}
+		_, _ = conn.Write(newHandshakeMessage(c.InfoHash, testPeerID))
+		bitfield := newBitfield(len(c.PieceHashes))
+		for i := range c.PieceHashes {
+			bitfield.Set(i)
+		}
+		_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgBitfield}, Payload: bitfield})
+		for {
+			msg, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			switch msg.Header.Type {
+			case msgInterested:
+				_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgUnchoke}})
+			case msgCancel:
+				cancelled <- struct{}{}
+			}
+		}
+	}()
+
+	c.Peers = []string{ln.Addr().String(), startFakePeer(t, &c, data, fakeSeeder)}
+	start := time.Now()
+	storage := NewMemoryStorage(c.Info.TotalLength())
+	if err := c.DownloadTo(storage); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.Bytes(), data) {
+		t.Errorf("downloaded data does not match")
+	}
+	if elapsed := time.Since(start); elapsed > peerTimeout/2 {
+		t.Errorf("download took %v waiting on the stalled peer", elapsed)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("stalled peer received no cancel")
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	block := requestPayloadToBytes(RequestPayload{Index: 1, Offset: 2, Length: 3})
+
+	tests := map[string]struct {
+		message Message
+		want    interface{}
+		wantErr bool
+	}{
+		"keep-alive":      {Message{}, keepAliveMsg{}, false},
+		"choke":           {Message{Header: MessageHeader{1, msgChoke}}, chokeMsg{}, false},
+		"unchoke":         {Message{Header: MessageHeader{1, msgUnchoke}}, unchokeMsg{}, false},
+		"have":            {Message{MessageHeader{5, msgHave}, []byte{0, 0, 1, 2}}, haveMsg{index: 258}, false},
+		"short have":      {Message{MessageHeader{3, msgHave}, []byte{0, 1}}, nil, true},
+		"bitfield":        {Message{MessageHeader{2, msgBitfield}, []byte{0xa0}}, bitfieldMsg{bitfield: Bitfield{0xa0}}, false},
+		"request":         {Message{MessageHeader{13, msgRequest}, block}, requestMsg{blockRequest{1, 2, 3}}, false},
+		"cancel":          {Message{MessageHeader{13, msgCancel}, block}, cancelMsg{blockRequest{1, 2, 3}}, false},
+		"long request":    {Message{MessageHeader{14, msgRequest}, append(block, 0)}, nil, true},
+		"piece":           {Message{MessageHeader{10, msgPiece}, append(block[:8:8], 'a')}, pieceMsg{1, 2, []byte("a")}, false},
+		"short piece":     {Message{MessageHeader{5, msgPiece}, block[:4]}, nil, true},
+		"extended":        {Message{MessageHeader{3, msgExtended}, []byte{3, 'x'}}, extendedMsg{3, []byte("x")}, false},
+		"unknown type":    {Message{MessageHeader{2, 99}, []byte{1}}, unknownMsg{99, []byte{1}}, false},
+		"choke with data": {Message{MessageHeader{2, msgChoke}, []byte{1}}, nil, true},
+		"suggest":         {Message{MessageHeader{5, msgSuggest}, []byte{0, 0, 0, 7}}, suggestMsg{index: 7}, false},
+		"have all":        {Message{Header: MessageHeader{1, msgHaveAll}}, haveAllMsg{}, false},
+		"have none":       {Message{Header: MessageHeader{1, msgHaveNone}}, haveNoneMsg{}, false},
+		"allowed fast":    {Message{MessageHeader{5, msgAllowedFast}, []byte{0, 0, 0, 7}}, allowedFastMsg{index: 7}, false},
+		"reject":          {Message{MessageHeader{13, msgRejected}, block}, rejectMsg{blockRequest{1, 2, 3}}, false},
+		"short reject":    {Message{MessageHeader{5, msgRejected}, block[:4]}, nil, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := decodeMessage(test.message)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wanted error: %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, wanted %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := map[string]struct {
+		data    []byte
+		want    Message
+		wantErr bool
+	}{
+		"keep-alive":    {[]byte{0, 0, 0, 0}, Message{}, false},
+		"have":          {[]byte{0, 0, 0, 5, msgHave, 0, 0, 1, 2}, Message{MessageHeader{5, msgHave}, []byte{0, 0, 1, 2}}, false},
+		"truncated":     {[]byte{0, 0, 0, 5, msgHave, 0}, Message{}, true},
+		"huge length":   {[]byte{0xff, 0xff, 0xff, 0xff, msgPiece}, Message{}, true},
+		"just too long": {binary.BigEndian.AppendUint32(nil, maxMessageLength+1), Message{}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := readMessage(bytes.NewReader(test.data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wanted error: %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, wanted %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPeerState(t *testing.T) {
+	pc := &peerConn{peerState: newPeerState(), pieces: 10, extended: true, has: newBitfield(10), pending: map[blockRequest]bool{}}
+	added := []int{}
+	pc.onHave = func(index int) { added = append(added, index) }
+	var bitfield Bitfield
+	pc.onBitfield = func(has Bitfield) { bitfield = append(Bitfield{}, has...) }
+
+	steps := []struct {
+		msg     interface{}
+		wantErr bool
+	}{
+		{keepAliveMsg{}, false},
+		{bitfieldMsg{Bitfield{0x80, 0x40}}, false},
+		{haveMsg{index: 3}, false},
+		{haveMsg{index: 0}, false}, // already announced
+		{unchokeMsg{}, false},
+		{interestedMsg{}, false},
+		{extendedMsg{id: 1}, false},
+		{bitfieldMsg{Bitfield{0xff, 0xc0}}, true}, // must come first
+		{haveMsg{index: 16}, true},                // out of range
+		{haveAllMsg{}, true},                      // needs the Fast Extension
+	}
+	for _, step := range steps {
+		if err := pc.handle(step.msg); (err != nil) != step.wantErr {
+			t.Errorf("%#v: got error %v, wanted error: %v", step.msg, err, step.wantErr)
+		}
+	}
+
+	if !reflect.DeepEqual(bitfield, Bitfield{0x80, 0x40}) {
+		t.Errorf("onBitfield called with %08b, wanted [10000000 01000000]", bitfield)
+	}
+	if !reflect.DeepEqual(added, []int{3}) {
+		t.Errorf("onHave called for %v, wanted [3]", added)
+	}
+	want := peerState{amChoking: true, peerInterested: true}
+	if pc.peerState != want {
+		t.Errorf("got state %+v, wanted %+v", pc.peerState, want)
+	}
+
+	// A choke drops the requests the peer has not answered.
+	pc.pending[blockRequest{0, 0, blockLength}] = true
+	if err := pc.handle(chokeMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if !pc.peerChoking || len(pc.pending) != 0 {
+		t.Errorf("got choked %v with %d pending requests, wanted true with none", pc.peerChoking, len(pc.pending))
+	}
+}
+
+func TestPeerStateExtendedFirst(t *testing.T) {
+	var hs bytes.Buffer
+	if err := bencode.Marshal(&hs, map[string]interface{}{"m": map[string]interface{}{"ut_pex": 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]interface{}{
+		"bitfield": bitfieldMsg{Bitfield{0xff, 0xc0}},
+		"have all": haveAllMsg{},
+	}
+
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			pc := &peerConn{peerState: newPeerState(), pieces: 10, fast: true, extended: true, has: newBitfield(10)}
+			if err := pc.handle(extendedMsg{id: extHandshake, payload: hs.Bytes()}); err != nil {
+				t.Fatal(err)
+			}
+			if err := pc.handle(msg); err != nil {
+				t.Fatalf("got error %v after the extended handshake", err)
+			}
+			if pc.has.Count() != 10 {
+				t.Errorf("peer has %d pieces, wanted 10", pc.has.Count())
+			}
+		})
+	}
+}
+
+func TestPeerStateFast(t *testing.T) {
+	pc := &peerConn{
+		peerState:   newPeerState(),
+		pieces:      10,
+		fast:        true,
+		has:         newBitfield(10),
+		allowedFast: map[int]bool{},
+		pending:     map[blockRequest]bool{},
+	}
+
+	steps := []struct {
+		msg     interface{}
+		wantErr bool
+	}{
+		{haveAllMsg{}, false},
+		{haveNoneMsg{}, true}, // must come first
+		{suggestMsg{index: 4}, false},
+		{suggestMsg{index: 12}, false}, // out of range, ignored
+		{allowedFastMsg{index: 2}, false},
+		{allowedFastMsg{index: 6}, false},
+		{unchokeMsg{}, false},
+	}
+	for _, step := range steps {
+		if err := pc.handle(step.msg); (err != nil) != step.wantErr {
+			t.Errorf("%#v: got error %v, wanted error: %v", step.msg, err, step.wantErr)
+		}
+	}
+
+	if pc.has.Count() != 10 {
+		t.Errorf("peer has %d pieces after have all, wanted 10", pc.has.Count())
+	}
+	if !reflect.DeepEqual(pc.suggested, []int{4}) {
+		t.Errorf("got suggested pieces %v, wanted [4]", pc.suggested)
+	}
+	if got := pc.allowedFastPieces(); !reflect.DeepEqual(got, []int{2, 6}) {
+		t.Errorf("got allowed fast pieces %v, wanted [2 6]", got)
+	}
+
+	// With the Fast Extension a choke keeps the pending requests, which the
+	// peer rejects one by one.
+	r := blockRequest{0, 0, blockLength}
+	pc.pending[r] = true
+	if err := pc.handle(chokeMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pc.pending) != 1 {
+		t.Errorf("got %d pending requests after choke, wanted 1", len(pc.pending))
+	}
+	if err := pc.handle(rejectMsg{r}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pc.pending) != 0 {
+		t.Errorf("got %d pending requests after reject, wanted none", len(pc.pending))
+	}
+}
+
+func TestAllowedFastSet(t *testing.T) {
+	// Example from BEP 6.
+	infoHash := strings.Repeat("\xaa", 20)
+	ip := net.ParseIP("80.4.4.200")
+
+	tests := map[string]struct {
+		ip     net.IP
+		pieces int
+		k      int
+		want   []int
+	}{
+		"k=7":        {ip, 1313, 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		"k=9":        {ip, 1313, 9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		"same /24":   {net.ParseIP("80.4.4.1"), 1313, 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		"few pieces": {ip, 3, 10, []int{0, 1, 2}},
+		"IPv6":       {net.ParseIP("2001:db8::1"), 1313, 7, nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := allowedFastSet(test.ip, infoHash, test.pieces, test.k)
+			if name == "few pieces" {
+				sort.Ints(got)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPiecePicker(t *testing.T) {
+	// Bitfields for 10 pieces, written as one character per piece.
+	bits := func(s string) Bitfield {
+		b := newBitfield(len(s))
+		for i, ch := range s {
+			if ch == '1' {
+				b.Set(i)
+			}
+		}
+		return b
+	}
+
+	tests := map[string]struct {
+		wanted []int
+		peers  []string // bitfields of the connected peers
+		haves  []int    // pieces announced in have messages
+		has    string   // bitfield of the peer picking
+		want   []int    // pieces picked, in order
+	}{
+		"rarest first": {
+			wanted: []int{0, 1, 2, 3},
+			peers:  []string{"1111000000", "1110000000", "1100000000", "1000000000"},
+			has:    "1111000000",
+			want:   []int{3, 2, 1, 0},
+		},
+		"only pieces the peer has": {
+			wanted: []int{0, 1, 2, 3},
+			peers:  []string{"1111000000", "0001000000", "1000000000"},
+			has:    "1100000000",
+			want:   []int{1, 0},
+		},
+		"only wanted pieces": {
+			wanted: []int{1, 3},
+			peers:  []string{"1111000000", "0001000000"},
+			has:    "1111000000",
+			want:   []int{1, 3},
+		},
+		"have messages count": {
+			wanted: []int{0, 1, 2},
+			peers:  []string{"1110000000"},
+			haves:  []int{0, 0, 2},
+			has:    "1110000000",
+			want:   []int{1, 2, 0},
+		},
+		"nothing to pick": {
+			wanted: []int{5},
+			peers:  []string{"1111000000"},
+			has:    "1111000000",
+			want:   []int{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newPiecePicker(10, test.wanted)
+			for _, peer := range test.peers {
+				p.AddPeer(bits(peer))
+			}
+			for _, i := range test.haves {
+				p.Have(i)
+			}
+
+			got := []int{}
+			for range test.wanted {
+				i, ok := p.Pick(bits(test.has))
+				if !ok {
+					break
+				}
+				got = append(got, i)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("picked %v, wanted %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("ties broken at random", func(t *testing.T) {
+		seen := map[int]bool{}
+		for n := 0; n < 100 && len(seen) < 3; n++ {
+			p := newPiecePicker(3, []int{0, 1, 2})
+			p.AddPeer(bits("111"))
+			i, _ := p.Pick(bits("111"))
+			seen[i] = true
+		}
+		if len(seen) != 3 {
+			t.Errorf("picked only pieces %v out of 3 equally rare ones", seen)
+		}
+	})
+
+	t.Run("abort and done", func(t *testing.T) {
+		p := newPiecePicker(2, []int{0, 1})
+		p.AddPeer(bits("11"))
+		p.Have(1)
+
+		first, _ := p.Pick(bits("11"))
+		changed := p.Changed()
+		p.Abort(first)
+		select {
+		case <-changed:
+		default:
+			t.Errorf("abort did not signal a change")
+		}
+		if again, _ := p.Pick(bits("11")); again != first {
+			t.Errorf("picked %d after abort, wanted %d", again, first)
+		}
+		if !p.Verified(first) {
+			t.Errorf("piece %d was not verified", first)
+		}
+		p.Done(first)
+		if got := p.Remaining(); got != 1 {
+			t.Errorf("%d pieces remaining, wanted 1", got)
+		}
+
+		// Once the only peer with the rarer piece leaves, both are equal.
+		p.RemovePeer(bits("11"))
+		if got := p.availability; !reflect.DeepEqual(got, []int{0, 1}) {
+			t.Errorf("availability %v after peer left, wanted [0 1]", got)
+		}
+	})
+
+	t.Run("endgame", func(t *testing.T) {
+		p := newPiecePicker(3, []int{0, 1, 2})
+		p.AddPeer(bits("111"))
+
+		// Three peers take one piece each, so nothing is left to pick.
+		changed := p.Changed()
+		picked := map[int]bool{}
+		for n := 0; n < 3; n++ {
+			i, _ := p.Pick(bits("111"))
+			picked[i] = true
+		}
+		if len(picked) != 3 {
+			t.Fatalf("picked %v, wanted every piece once", picked)
+		}
+		select {
+		case <-changed:
+		default:
+			t.Errorf("idle peers were not woken up for endgame mode")
+		}
+
+		// One piece is verified, so a fourth peer doubles up on another.
+		if !p.Verified(0) {
+			t.Errorf("piece 0 was not verified")
+		}
+		i, ok := p.Pick(bits("111"))
+		if !ok || i == 0 {
+			t.Fatalf("picked %d, %v in endgame mode, wanted piece 1 or 2", i, ok)
+		}
+		finished := p.Finished(i)
+
+		// The first copy wins and the other peer is told to stop.
+		if !p.Verified(i) {
+			t.Errorf("first copy of piece %d was not verified", i)
+		}
+		select {
+		case <-finished:
+		default:
+			t.Errorf("finished channel of piece %d was not closed", i)
+		}
+		if p.Verified(i) {
+			t.Errorf("second copy of piece %d was verified", i)
+		}
+		p.Abort(i)
+		p.Done(0)
+		p.Done(i)
+		if got := p.Remaining(); got != 1 {
+			t.Errorf("%d pieces remaining, wanted 1", got)
+		}
+	})
+}
+
+func TestMultiFileInfo(t *testing.T) {
+	torrent := "d8:announce9:http://x/4:infod5:filesld6:lengthi5e4:pathl1:a5:b.txteed6:lengthi0e4:pathl5:emptyeed6:lengthi7e4:pathl5:c.txteee4:name3:dir12:piece lengthi8e6:pieces40:0123456789012345678901234567890123456789ee"
+	c := Client{}
+	if err := decodeTorrentFile(torrent, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Info.validateFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		got  interface{}
+		want interface{}
+	}{
+		"is multi-file": {c.Info.IsMultiFile(), true},
+		"total length":  {c.Info.TotalLength(), 12},
+		"file entries": {c.Info.fileEntries(), []fileEntry{
+			{Path: filepath.Join("dir", "a", "b.txt"), Length: 5, Offset: 0},
+			{Path: filepath.Join("dir", "empty"), Length: 0, Offset: 5},
+			{Path: filepath.Join("dir", "c.txt"), Length: 7, Offset: 5},
+		}},
+		"last piece length": {c.pieceLength(1), 4},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !reflect.DeepEqual(test.got, test.want) {
+				t.Errorf("got %v, wanted %v", test.got, test.want)
+			}
+		})
+	}
+
+	t.Run("rejects path traversal", func(t *testing.T) {
+		info := TorrentInfo{Name: "dir", Files: []FileInfo{{Length: 1, Path: []string{"..", "x"}}}}
+		if err := info.validateFiles(); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func TestStorageBackends(t *testing.T) {
+	files := []fileEntry{
+		{Path: filepath.Join("dir", "a", "b.txt"), Length: 5, Offset: 0},
+		{Path: filepath.Join("dir", "empty"), Length: 0, Offset: 5},
+		{Path: filepath.Join("dir", "c.txt"), Length: 7, Offset: 5},
+		{Path: filepath.Join("dir", "trailing"), Length: 0, Offset: 12},
+	}
+
+	tests := map[string]struct {
+		create func(root string) (Storage, error)
+		onDisk bool // whether the data ends up in the files
+	}{
+		"sparse files": {func(root string) (Storage, error) { return createFileStorage(root, files, false) }, true},
+		"full files":   {func(root string) (Storage, error) { return createFileStorage(root, files, true) }, true},
+		"mmap":         {func(root string) (Storage, error) { return createMmapStorage(root, files) }, true},
+		"memory":       {func(root string) (Storage, error) { return NewMemoryStorage(12), nil }, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			s, err := test.create(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// Write out of order and across file boundaries.
+			for _, w := range []struct {
+				data string
+				off  int64
+			}{{"ld!!", 8}, {"hel", 0}, {"lowor", 3}} {
+				if _, err := s.WriteAt([]byte(w.data), w.off); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Read the data back across file boundaries.
+			buf := make([]byte, 6)
+			if _, err := s.ReadAt(buf, 2); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "llowor" {
+				t.Errorf("got %q, wanted %q", buf, "llowor")
+			}
+			if _, err := s.ReadAt(buf, 10); err != io.EOF {
+				t.Errorf("got error %v reading past the end, wanted EOF", err)
+			}
+			if _, err := s.WriteAt(buf, 10); err == nil {
+				t.Errorf("expected an error writing past the end")
+			}
+
+			if err := syncStorage(s); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !test.onDisk {
+				return
+			}
+
+			want := map[string]string{
+				files[0].Path: "hello",
+				files[1].Path: "",
+				files[2].Path: "world!!",
+				files[3].Path: "",
+			}
+			for path, contents := range want {
+				got, err := os.ReadFile(filepath.Join(root, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != contents {
+					t.Errorf("%s: got %q, wanted %q", path, got, contents)
+				}
+			}
+
+			r, err := openFileStorage(root, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if _, err := r.ReadAt(buf, 0); err != nil || string(buf) != "hellow" {
+				t.Errorf("got %q, %v reading the files back", buf, err)
+			}
+		})
+	}
+}
+
+func TestStorageHadData(t *testing.T) {
+	files := []fileEntry{
+		{Path: filepath.Join("dir", "a", "b.txt"), Length: 5, Offset: 0},
+		{Path: filepath.Join("dir", "empty"), Length: 4, Offset: 5},
+		{Path: filepath.Join("dir", "c.txt"), Length: 7, Offset: 9},
+	}
+	backends := map[string]func(root string) (Storage, error){
+		"file": func(root string) (Storage, error) { return createFileStorage(root, files, false) },
+		"mmap": func(root string) (Storage, error) { return createMmapStorage(root, files) },
+	}
+	ranges := []struct {
+		off, length int64
+		want        bool
+	}{
+		{0, 5, false},  // created by the storage
+		{3, 5, false},  // into a file that existed but was empty
+		{7, 3, true},   // into the file that held data
+		{9, 7, true},   // within it
+		{16, 0, false}, // at the end
+	}
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(root, "dir"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, files[1].Path), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, files[2].Path), []byte("world!!"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := create(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			r, ok := s.(resumable)
+			if !ok {
+				t.Fatalf("%T does not report which data it had", s)
+			}
+			for _, rg := range ranges {
+				if got := r.HadData(rg.off, rg.length); got != rg.want {
+					t.Errorf("%d bytes at %d: got %v, wanted %v", rg.length, rg.off, got, rg.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadToMemory(t *testing.T) {
+	c, data := newTestClient(t, 100000, 16384)
+	c.Peers = []string{startFakePeer(t, &c, data, fakeSeeder)}
+
+	storage := NewMemoryStorage(c.Info.TotalLength())
+	if err := c.DownloadTo(storage); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.Bytes(), data) {
+		t.Errorf("downloaded data does not match")
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	hash, _ := hex.DecodeString("ad42ce8109f54c99613ce38f9b4d87e70f24a165")
+
+	tests := map[string]struct {
+		uri     string
+		want    Magnet
+		wantErr bool
+	}{
+		"hex info hash with tracker": {
+			"magnet:?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165&dn=magnet1.gif" +
+				"&tr=http%3A%2F%2Fbittorrent-test-tracker.codecrafters.io%2Fannounce",
+			Magnet{
+				InfoHash: string(hash),
+				Name:     "magnet1.gif",
+				Trackers: []string{"http://bittorrent-test-tracker.codecrafters.io/announce"},
+			},
+			false,
+		},
+		"base32 info hash and peer": {
+			"magnet:?xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJILF&x.pe=127.0.0.1:6881",
+			Magnet{InfoHash: string(hash), Peers: []string{"127.0.0.1:6881"}},
+			false,
+		},
+		"missing info hash": {"magnet:?dn=foo", Magnet{}, true},
+		"not a magnet link": {"http://example.com/?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165", Magnet{}, true},
+		"short info hash":   {"magnet:?xt=urn:btih:ad42ce", Magnet{}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseMagnet(test.uri)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wanted error %t", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, wanted %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	seed, data := newTestClient(t, 100000, 16384)
+	addr := startFakePeer(t, &seed, data, fakeSeeder)
+
+	// A client that only knows the info hash, as from a magnet link.
+	c := Client{InfoHash: seed.InfoHash, Peers: []string{addr}}
+	if err := c.FetchMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.Info, seed.Info) {
+		t.Errorf("got info %+v, wanted %+v", c.Info, seed.Info)
+	}
+	if !reflect.DeepEqual(c.PieceHashes, seed.PieceHashes) {
+		t.Errorf("piece hashes do not match")
+	}
+}
+
+func TestSeedMetadata(t *testing.T) {
+	seeder, data := newTestClient(t, 100000, 16384)
+	storage := NewMemoryStorage(len(data))
+	if _, err := storage.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	seeder.Have = seeder.verifyPieces(storage)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { _ = seeder.serve(ln, storage) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, ext, err := HandshakeExtended(conn, seeder.InfoHash, testPeerID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ExtendedHandshake{
+		M:            map[string]int{"ut_metadata": extUtMetadata},
+		V:            clientVersion,
+		MetadataSize: len(seeder.RawInfo),
+		Reqq:         maxPeerRequests,
+	}
+	if !reflect.DeepEqual(ext, want) {
+		t.Errorf("got extended handshake %+v, wanted %+v", ext, want)
+	}
+
+	rawInfo, err := downloadMetadata(conn, ext, seeder.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawInfo != seeder.RawInfo {
+		t.Errorf("metadata does not match")
+	}
+}
+
+func TestHandleExtended(t *testing.T) {
+	const testID = 200
+	received := [][]byte{}
+	registerExtension(extension{name: "test_ext", id: testID, handle: func(pc *peerConn, payload []byte) error {
+		received = append(received, payload)
+		return nil
+	}})
+	defer delete(extensions, testID)
+
+	if got := ourExtendedHandshake(0, false).M["test_ext"]; got != testID {
+		t.Errorf("test_ext advertised with ID %d, wanted %d", got, testID)
+	}
+
+	pc := &peerConn{peerState: newPeerState(), extended: true}
+	handshake := func(h ExtendedHandshake) extendedMsg {
+		payload := &bytes.Buffer{}
+		if err := bencode.Marshal(payload, h); err != nil {
+			t.Fatal(err)
+		}
+		return extendedMsg{id: extHandshake, payload: payload.Bytes()}
+	}
+
+	steps := []struct {
+		msg     interface{}
+		wantErr bool
+	}{
+		{handshake(ExtendedHandshake{M: map[string]int{"ut_metadata": 3, "ut_pex": 1}, V: "Test 1.0", Reqq: 64}), false},
+		{handshake(ExtendedHandshake{M: map[string]int{"ut_pex": 0}}), false}, // disables ut_pex only
+		{extendedMsg{id: testID, payload: []byte("x")}, false},
+		{extendedMsg{id: 99}, false}, // not ours, ignored
+		{extendedMsg{id: extHandshake, payload: []byte("garbage")}, true},
+	}
+	for _, step := range steps {
+		if err := pc.handle(step.msg); (err != nil) != step.wantErr {
+			t.Errorf("%#v: got error %v, wanted error: %v", step.msg, err, step.wantErr)
+		}
+	}
+
+	if !pc.ext.Supports("ut_metadata") || pc.ext.Supports("ut_pex") {
+		t.Errorf("got extensions %v, wanted only ut_metadata enabled", pc.ext.M)
+	}
+	if pc.ext.V != "Test 1.0" || pc.ext.Reqq != 64 {
+		t.Errorf("got version %q and reqq %d, wanted \"Test 1.0\" and 64", pc.ext.V, pc.ext.Reqq)
+	}
+	if !reflect.DeepEqual(received, [][]byte{[]byte("x")}) {
+		t.Errorf("handler received %q, wanted [x]", received)
+	}
+
+	// Without the extension bit in the handshake extended messages are a
+	// protocol error.
+	pc = &peerConn{peerState: newPeerState()}
+	if err := pc.handle(extendedMsg{id: testID}); err == nil {
+		t.Errorf("extended message accepted without the extension protocol")
+	}
+}
+
+func TestReadHandshake(t *testing.T) {
+	infoHash := strings.Repeat("i", 20)
+	valid := newHandshakeMessage(infoHash, testPeerID)
+	corrupt := func(at int, b byte) []byte {
+		msg := append([]byte{}, valid...)
+		msg[at] = b
+		return msg
+	}
+
+	tests := map[string]struct {
+		resp    []byte
+		wantErr error // nil if any error will do
+		ok      bool
+	}{
+		"valid":               {valid, nil, true},
+		"wrong pstrlen":       {corrupt(0, 18), nil, false},
+		"wrong pstr":          {corrupt(1, 'b'), nil, false},
+		"other torrent":       {newHandshakeMessage(strings.Repeat("o", 20), testPeerID), nil, false},
+		"ourselves":           {newHandshakeMessage(infoHash, PeerID), errSelfConnection, false},
+		"short":               {valid[:60], io.ErrUnexpectedEOF, false},
+		"closed before reply": {nil, io.EOF, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The reply arrives one byte at a time.
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{iotest.OneByteReader(bytes.NewReader(test.resp)), io.Discard}
+			peer, err := Handshake(conn, infoHash, PeerID)
+			if test.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if peer.PeerID != testPeerID || !peer.Fast || !peer.Extended {
+					t.Errorf("got %+v", peer)
+				}
+				return
+			}
+			if err == nil || (test.wantErr != nil && err != test.wantErr) {
+				t.Errorf("got error %v, wanted %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandshakeReserved(t *testing.T) {
+	peer, err := parseHandshake(newHandshakeMessage(strings.Repeat("x", 20), PeerID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Fast || !peer.Extended {
+		t.Errorf("got fast %v and extended %v, wanted both", peer.Fast, peer.Extended)
+	}
+}
+
+func TestPeerID(t *testing.T) {
+	a, b := newPeerID(), newPeerID()
+	if len(a) != 20 || !strings.HasPrefix(a, peerIDPrefix) {
+		t.Errorf("got peer ID %q, wanted 20 bytes starting with %q", a, peerIDPrefix)
+	}
+	if a == b {
+		t.Errorf("got the same peer ID %q twice", a)
+	}
+
+	saved := PeerID
+	defer func() { PeerID = saved }()
+	if err := setPeerID("too short"); err == nil || PeerID != saved {
+		t.Errorf("got error %v and peer ID %q, wanted an error and %q", err, PeerID, saved)
+	}
+	if err := setPeerID(testPeerID); err != nil || PeerID != testPeerID {
+		t.Errorf("got error %v and peer ID %q, wanted %q", err, PeerID, testPeerID)
+	}
+
+	// The tracker sees the ID the client presents in its handshakes.
+	announced := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced <- r.URL.Query().Get("peer_id")
+		_ = bencode.Marshal(w, GetPeersResponse{Interval: 1800})
+	}))
+	defer srv.Close()
+	c := Client{Announce: srv.URL + "/announce", InfoHash: strings.Repeat("x", 20), PeerID: a}
+	if err := c.FindPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-announced; got != a {
+		t.Errorf("announced peer ID %q, wanted %q", got, a)
+	}
+}
+
+func TestIdentifyClient(t *testing.T) {
+	tests := map[string]struct {
+		peerID string
+		want   string
+	}{
+		"qBittorrent":         {"-qB4520-abcdefghijkl", "qBittorrent 4.5.2"},
+		"Transmission":        {"-TR2940-abcdefghijkl", "Transmission 2.94"},
+		"libtorrent":          {"-LT1200-abcdefghijkl", "libtorrent (Rasterbar) 1.2"},
+		"uTorrent":            {"-UT355W-abcdefghijkl", "µTorrent 3.5.5.32"},
+		"ours":                {newPeerID(), "mybittorrent 0.0.0.1"},
+		"unknown Azureus":     {"-ZZ1000-abcdefghijkl", "ZZ 1.0"},
+		"mainline":            {"M7-4-0--abcdefghijkl", "BitTorrent 7.4.0"},
+		"mainline two digits": {"M4-20-8-abcdefghijkl", "BitTorrent 4.20.8"},
+		"Shadow":              {"S58B-----abcdefghijk", "Shadow 5.8.11"},
+		"BitTornado":          {"T03I--abcdefghijklmn", "BitTornado 0.3.18"},
+		"BitComet":            {"exbc\x00\x3cabcdefghijkl", "BitComet 0.60"},
+		"unknown":             {"00112233445566778899", "unknown"},
+		"short":               {"-qB", "unknown"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := identifyClient(test.peerID); got != test.want {
+				t.Errorf("got %q, wanted %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleMetadata(t *testing.T) {
+	request := &bytes.Buffer{}
+	if err := bencode.Marshal(request, MetadataMessage{MsgType: metadataRequest, Piece: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		rawInfo string
+		want    MetadataMessage
+	}{
+		"serves the info dictionary": {"d4:name1:xe", MetadataMessage{MsgType: metadataData, TotalSize: 11}},
+		"rejects without metadata":   {"", MetadataMessage{MsgType: metadataReject}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pc, _, received := pipePeer(t, 1)
+			pc.extended = true
+			pc.ext = ExtendedHandshake{M: map[string]int{"ut_metadata": 3}}
+			pc.rawInfo = test.rawInfo
+
+			if err := pc.handle(extendedMsg{id: extUtMetadata, payload: request.Bytes()}); err != nil {
+				t.Fatal(err)
+			}
+			msg := <-received
+			if msg.Header.Type != msgExtended || msg.Payload[0] != 3 {
+				t.Fatalf("got message type %d, wanted a ut_metadata message", msg.Header.Type)
+			}
+			got, data, err := parseMetadataMessage(msg.Payload[1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want || string(data) != test.rawInfo {
+				t.Errorf("got %+v with %q, wanted %+v with %q", got, data, test.want, test.rawInfo)
+			}
+		})
+	}
+}
+
+func TestSwarm(t *testing.T) {
+	s := newSwarm([]string{"a:1", "b:2", "a:1"})
+	if n := s.Add("x:9", []string{"b:2", "c:3", "d:4", "e:5"}); n != 3 {
+		t.Errorf("added %d new peers, wanted 3", n)
+	}
+	select {
+	case <-s.Added():
+	default:
+		t.Errorf("no signal after adding peers")
+	}
+	// Only the peer that reported an address can drop it.
+	s.Drop("y:8", []string{"b:2", "e:5"})
+	s.Drop("x:9", []string{"b:2", "c:3"})
+
+	got := []string{}
+	for {
+		addr, ok := s.Next()
+		if !ok {
+			break
+		}
+		got = append(got, addr)
+	}
+	if want := []string{"a:1", "b:2", "d:4", "e:5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("connected to %v, wanted %v", got, want)
+	}
+
+	// Peers being dialed are not connected yet.
+	if got := s.Connected(); len(got) != 0 || s.Active() != 4 {
+		t.Errorf("got connected peers %v and %d active, wanted none and 4", got, s.Active())
+	}
+	s.Handshaken("a:1")
+	s.Handshaken("b:2")
+
+	// Peers being dialed or connected are never queued again, dropped ones
+	// may be.
+	s.Drop("x:9", []string{"a:1", "d:4"})
+	if n := s.Add("x:9", []string{"a:1", "c:3", "d:4"}); n != 1 {
+		t.Errorf("added %d new peers, wanted 1", n)
+	}
+	s.Disconnected("b:2")
+	s.Disconnected("d:4") // dial failed
+	s.Disconnected("e:5")
+	if got, want := s.Connected(), []string{"a:1"}; !reflect.DeepEqual(got, want) || s.Active() != 1 {
+		t.Errorf("got connected peers %v and %d active, wanted %v and 1", got, s.Active(), want)
+	}
+}
+
+func TestPexMessage(t *testing.T) {
+	sent := map[string]bool{"10.0.0.1:80": true, "[2001:db8::2]:80": true}
+	msg := newPexMessage([]string{"10.0.0.1:80", "10.0.0.2:6881", "[2001:db8::1]:6882"}, sent)
+
+	payload := &bytes.Buffer{}
+	if err := bencode.Marshal(payload, msg); err != nil {
+		t.Fatal(err)
+	}
+	added, dropped, err := parsePexMessage(payload.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantAdded := []pexPeer{{"10.0.0.2:6881", pexReachable}, {"[2001:db8::1]:6882", pexReachable}}
+	if !reflect.DeepEqual(added, wantAdded) {
+		t.Errorf("got added %v, wanted %v", added, wantAdded)
+	}
+	if want := []string{"[2001:db8::2]:80"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("got dropped %v, wanted %v", dropped, want)
+	}
+	wantSent := map[string]bool{"10.0.0.1:80": true, "10.0.0.2:6881": true, "[2001:db8::1]:6882": true}
+	if !reflect.DeepEqual(sent, wantSent) {
+		t.Errorf("got sent %v, wanted %v", sent, wantSent)
+	}
+
+	// Flags are optional, and missing ones read as 0.
+	payload.Reset()
+	if err := bencode.Marshal(payload, PexMessage{Added: "\x01\x02\x03\x04\x00\x50"}); err != nil {
+		t.Fatal(err)
+	}
+	added, _, err = parsePexMessage(payload.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []pexPeer{{"1.2.3.4:80", 0}}; !reflect.DeepEqual(added, want) {
+		t.Errorf("got added %v, wanted %v", added, want)
+	}
+}
+
+func TestSendPex(t *testing.T) {
+	pc, _, received := pipePeer(t, 1)
+	pc.ext.M = map[string]int{"ut_pex": 9}
+
+	// The peer is not told about itself.
+	if err := pc.sendPex([]string{"10.0.0.1:80", pc.addr}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-received
+	if msg.Header.Type != msgExtended || msg.Payload[0] != 9 {
+		t.Fatalf("got message type %d, wanted ut_pex", msg.Header.Type)
+	}
+	added, _, err := parsePexMessage(msg.Payload[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []pexPeer{{"10.0.0.1:80", pexReachable}}; !reflect.DeepEqual(added, want) {
+		t.Errorf("got added %v, wanted %v", added, want)
+	}
+
+	// Nothing is sent again before pexInterval has passed.
+	if err := pc.sendPex(nil); err != nil {
+		t.Fatal(err)
+	}
+	pc.pexNext = time.Now()
+	if err := pc.sendPex(nil); err != nil {
+		t.Fatal(err)
+	}
+	msg = <-received
+	_, dropped, err := parsePexMessage(msg.Payload[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:80"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("got dropped %v, wanted %v", dropped, want)
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected message of type %d", msg.Header.Type)
+	default:
+	}
+}
+
+func TestDownloadPex(t *testing.T) {
+	tests := map[string]struct {
+		private int
+		wantErr bool
+	}{
+		"public torrent finds the seeder": {0, false},
+		"private torrent ignores pex":     {1, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, data := newTestClient(t, 50000, 16384)
+			c.Info.Private = test.private
+			seeder := startFakePeer(t, &c, data, fakeSeeder)
+
+			// The only peer the tracker knows has no pieces, but tells us
+			// about the seeder before hanging up.
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			ours := make(chan ExtendedHandshake, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if _, err := readHandshake(conn); err != nil {
+					return
+				}
+				_, _ = conn.Write(newHandshakeMessage(c.InfoHash, testPeerID))
+				_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgHaveNone}})
+				payload, err := receiveExtended(conn, extHandshake)
+				if err != nil {
+					return
+				}
+				h, _ := parseExtendedHandshake(payload)
+				ours <- h
+				_ = sendExtendedMessage(conn, extHandshake, ExtendedHandshake{M: map[string]int{"ut_pex": 1}})
+				v4, _ := compactPeers([]string{seeder})
+				_ = sendExtendedMessage(conn, extUtPex, PexMessage{Added: v4})
+			}()
+
+			c.Peers = []string{ln.Addr().String()}
+			got := make([]byte, len(data))
+			err = c.downloadPieces([]int{0, 1, 2, 3}, func(index int, piece []byte) error {
+				copy(got[index*c.Info.PieceLength:], piece)
+				return nil
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wanted error: %v", err, test.wantErr)
+			}
+			if !test.wantErr && !bytes.Equal(got, data) {
+				t.Errorf("downloaded data does not match")
+			}
+			if h := <-ours; h.Supports("ut_pex") == c.Info.IsPrivate() {
+				t.Errorf("ut_pex offered: %v, private: %v", h.Supports("ut_pex"), c.Info.IsPrivate())
+			}
+		})
+	}
+}
+
+func TestDHT(t *testing.T) {
+	// A swarm of nodes that all join through the first one.
+	nodes := []*DHT{}
+	for i := 0; i < 20; i++ {
+		d, err := NewDHT("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		d.Timeout = time.Second
+		nodes = append(nodes, d)
+	}
+	router := nodes[0].Addr()
+	for _, d := range nodes[1:] {
+		if err := d.Bootstrap([]string{router}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infoHash := strings.Repeat("\x42", 20)
+	if _, err := nodes[5].Announce(infoHash, 6881); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[9].Announce(infoHash, 6882); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := nodes[17].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(peers)
+	if want := []string{"127.0.0.1:6881", "127.0.0.1:6882"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got peers %v, wanted %v", peers, want)
+	}
+
+	// A node restarted from its state file knows the swarm without a router.
+	path := filepath.Join(t.TempDir(), "dht.state")
+	if err := nodes[17].Save(path); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := LoadDHT("127.0.0.1:0", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if restarted.ID != nodes[17].ID || restarted.Nodes() != nodes[17].Nodes() {
+		t.Errorf("restarted node has ID %x and %d nodes, wanted %x and %d",
+			restarted.ID, restarted.Nodes(), nodes[17].ID, nodes[17].Nodes())
+	}
+	restarted.Routers = nil
+	if err := restarted.Bootstrap(nil); err != nil {
+		t.Fatal(err)
+	}
+	if peers, err := restarted.GetPeers(infoHash); err != nil || len(peers) != 2 {
+		t.Errorf("got peers %v, %v after restart, wanted 2", peers, err)
+	}
+}
+
+func TestDHTStaleState(t *testing.T) {
+	router, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	d, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.Timeout = 100 * time.Millisecond
+	d.Routers = []string{router.Addr()}
+
+	// The nodes from an old state file no longer answer.
+	for i := 0; i < dhtK; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		d.table.Seen(randomNodeID(), conn.LocalAddr().String())
+	}
+
+	if err := d.Bootstrap(nil); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range d.table.Nodes() {
+		found = found || n.Addr == router.Addr()
+	}
+	if !found {
+		t.Errorf("router not in the routing table after bootstrap")
+	}
+}
+
+func TestDHTQueries(t *testing.T) {
+	d, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	client, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Timeout = time.Second
+
+	infoHash := strings.Repeat("\x42", 20)
+	tests := map[string]struct {
+		method  string
+		args    krpcArgs
+		wantErr bool
+	}{
+		"ping":                     {"ping", krpcArgs{}, false},
+		"find_node":                {"find_node", krpcArgs{Target: infoHash}, false},
+		"find_node without target": {"find_node", krpcArgs{}, true},
+		"get_peers":                {"get_peers", krpcArgs{InfoHash: infoHash}, false},
+		"announce_peer bad token":  {"announce_peer", krpcArgs{InfoHash: infoHash, Port: 1, Token: "x"}, true},
+		"unknown method":           {"vote", krpcArgs{}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := client.query(d.Addr(), test.method, test.args)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, wanted error: %v", err, test.wantErr)
+			}
+		})
+	}
+
+	// Tokens from get_peers allow announcing, with the port implied by the
+	// source address if asked.
+	r, err := client.query(d.Addr(), "get_peers", krpcArgs{InfoHash: infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := krpcArgs{InfoHash: infoHash, Port: 1, ImpliedPort: 1, Token: r.Token}
+	if _, err := client.query(d.Addr(), "announce_peer", args); err != nil {
+		t.Fatal(err)
+	}
+	r, err = client.query(d.Addr(), "get_peers", krpcArgs{InfoHash: infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Values) != 1 || parseCompactPeers(r.Values[0])[0] != client.Addr() {
+		t.Errorf("got values %q, wanted %s", r.Values, client.Addr())
+	}
+	if d.Nodes() != 1 {
+		t.Errorf("node knows %d nodes, wanted the one that queried it", d.Nodes())
+	}
+}
+
+func TestDHTPeerList(t *testing.T) {
+	router, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	host, port, _ := net.SplitHostPort(router.Addr())
+	portNum, _ := strconv.Atoi(port)
+
+	// The torrent has no trackers, only a DHT node.
+	torrent := fmt.Sprintf("d4:infod6:lengthi1e4:name1:x12:piece lengthi1e6:pieces20:%se5:nodesll%d:%si%deeee",
+		strings.Repeat("x", 20), len(host), host, portNum)
+	path := filepath.Join(t.TempDir(), "x.torrent")
+	if err := os.WriteFile(path, []byte(torrent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	seeder, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	seederClient, err := LoadTorrent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seederClient.DHT = seeder
+	if err := seederClient.FindPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if got := seederClient.dhtNodes(); !reflect.DeepEqual(got, []string{router.Addr()}) {
+		t.Errorf("got torrent nodes %v, wanted [%s]", got, router.Addr())
+	}
+
+	leecher, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	c, err := LoadTorrent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DHT = leecher
+	if err := c.FindPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{fmt.Sprintf("127.0.0.1:%d", defaultPort)}; !reflect.DeepEqual(c.Peers, want) {
+		t.Errorf("got peers %v, wanted %v", c.Peers, want)
+	}
+}
+
+func TestCreateTorrent(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "share")
+	contents := map[string][]byte{
+		filepath.Join("a.txt"):        []byte("hello\n"),
+		filepath.Join("sub", "b.bin"): bytes.Repeat([]byte{1, 2, 3}, 20000),
+	}
+	for path, data := range contents {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, err := CreateTorrent(CreateOptions{
+		Path:         root,
+		Announce:     []string{"http://a/announce", "http://b/announce"},
+		Comment:      "test",
+		Private:      true,
+		CreationDate: time.Unix(1700000000, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the torrent back the way a downloader would.
+	buf := &bytes.Buffer{}
+	if err := WriteTorrent(buf, meta); err != nil {
+		t.Fatal(err)
+	}
+	c := Client{}
+	if err := decodeTorrentFile(buf.String(), &c); err != nil {
+		t.Fatal(err)
+	}
+	rawInfo, err := rawDictValue(buf.String(), "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.loadInfo(rawInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	data := append(append([]byte{}, contents["a.txt"]...), contents[filepath.Join("sub", "b.bin")]...)
+	for i, hash := range c.PieceHashes {
+		begin := i * c.Info.PieceLength
+		if !pieceIsValid(hash, data[begin:begin+c.pieceLength(i)]) {
+			t.Errorf("piece %d hash does not match the data", i)
+		}
+	}
+
+	tests := map[string]struct {
+		got  interface{}
+		want interface{}
+	}{
+		"announce":      {c.Announce, "http://a/announce"},
+		"announce list": {meta.AnnounceList, [][]string{{"http://a/announce"}, {"http://b/announce"}}},
+		"name":          {c.Info.Name, "share"},
+		"private":       {c.Info.Private, 1},
+		"piece length":  {c.Info.PieceLength, minAutoPieceLength},
+		"piece count":   {len(c.PieceHashes), 4},
+		"files": {c.Info.Files, []FileInfo{
+			{Length: 6, Path: []string{"a.txt"}},
+			{Length: 60000, Path: []string{"sub", "b.bin"}},
+		}},
+		"creation date": {meta.CreationDate, int64(1700000000)},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !reflect.DeepEqual(test.got, test.want) {
+				t.Errorf("got %v, wanted %v", test.got, test.want)
+			}
+		})
+	}
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	tests := map[string]struct {
+		length int
+		want   int
+	}{
+		"tiny file":    {1, minAutoPieceLength},
+		"medium file":  {100 * 1024 * 1024, 128 * 1024},
+		"huge file":    {1 << 40, maxAutoPieceLength},
+		"exact target": {targetPieceCount * minAutoPieceLength, 2 * minAutoPieceLength},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := autoPieceLength(test.length); got != test.want {
+				t.Errorf("got %d, wanted %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUDPTracker(t *testing.T) {
+	infoHash := "abcdefghijklmnopqrst"
+	peers := string([]byte{127, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2})
+
+	t.Run("announce through discoverPeers", func(t *testing.T) {
+		tracker := startFakeUDPTracker(t, infoHash, peers)
+		c := Client{Announce: "udp://" + tracker.addr() + "/announce", InfoHash: infoHash}
+		if err := c.FindPeers(); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"127.0.0.1:6881", "10.0.0.2:6882"}
+		if !reflect.DeepEqual(c.Peers, want) {
+			t.Errorf("got %v, wanted %v", c.Peers, want)
+		}
+	})
+
+	t.Run("reuses connection ID", func(t *testing.T) {
+		tracker := startFakeUDPTracker(t, infoHash, peers)
+		ut := NewUDPTracker(tracker.addr())
+		for i := 0; i < 3; i++ {
+			resp, err := ut.Announce(infoHash, PeerID, 100, defaultPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Complete != 3 || resp.Incomplete != 2 || resp.Interval != 1800 {
+				t.Errorf("got %+v", resp)
+			}
+		}
+		if got := atomic.LoadInt32(&tracker.connects); got != 1 {
+			t.Errorf("got %d connect requests, wanted 1", got)
+		}
+	})
+
+	t.Run("retransmits after timeouts", func(t *testing.T) {
+		tracker := startFakeUDPTracker(t, infoHash, peers)
+		atomic.StoreInt32(&tracker.drop, 2)
+		ut := NewUDPTracker(tracker.addr())
+		ut.BaseTimeout = 20 * time.Millisecond
+		resp, err := ut.Announce(infoHash, PeerID, 100, defaultPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Peers != peers {
+			t.Errorf("got peers %q, wanted %q", resp.Peers, peers)
+		}
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		tracker := startFakeUDPTracker(t, infoHash, peers)
+		atomic.StoreInt32(&tracker.drop, 1000)
+		ut := NewUDPTracker(tracker.addr())
+		ut.BaseTimeout = 5 * time.Millisecond
+		ut.MaxRetries = 2
+		if _, err := ut.Announce(infoHash, PeerID, 100, defaultPort); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("gives up after timeout", func(t *testing.T) {
+		tracker := startFakeUDPTracker(t, infoHash, peers)
+		atomic.StoreInt32(&tracker.drop, 1000)
+		ut := NewUDPTracker(tracker.addr())
+		ut.Timeout = 50 * time.Millisecond
+		start := time.Now()
+		if _, err := ut.Announce(infoHash, PeerID, 100, defaultPort); err == nil {
+			t.Errorf("expected an error")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("gave up after %v, wanted about %v", elapsed, ut.Timeout)
+		}
+	})
+
+	t.Run("reports tracker errors", func(t *testing.T) {
+		tracker := startFakeUDPTracker(t, infoHash, peers)
+		if _, err := NewUDPTracker(tracker.addr()).Announce("unknown torrent hash", PeerID, 100, defaultPort); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+
+	t.Run("scrape", func(t *testing.T) {
+		tracker := startFakeUDPTracker(t, infoHash, peers)
+		c := Client{Announce: "udp://" + tracker.addr(), InfoHash: infoHash}
+		got, err := c.Scrape()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ScrapeResult{Seeders: 3, Completed: 10, Leechers: 2}
+		if got != want {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+	})
+}
+
+func TestAnnounceList(t *testing.T) {
+	infoHash := "abcdefghijklmnopqrst"
+	httpTracker := func(peers string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = bencode.Marshal(w, GetPeersResponse{Interval: 1800, Peers: peers})
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL + "/announce"
+	}
+	dead := "http://127.0.0.1:1/announce"
+	first := httpTracker(string([]byte{10, 0, 0, 1, 0x1a, 0xe1}))
+	second := httpTracker(string([]byte{10, 0, 0, 2, 0x1a, 0xe1, 10, 0, 0, 1, 0x1a, 0xe1}))
+	udp := startFakeUDPTracker(t, infoHash, string([]byte{10, 0, 0, 3, 0x1a, 0xe1}))
+
+	c := Client{
+		Announce: dead,
+		AnnounceList: [][]string{
+			{dead, first},
+			{"udp://" + udp.addr()},
+		},
+		InfoHash: infoHash,
+	}
+	if err := c.FindPeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The later tiers are only used once the ones before them fail.
+	fallback := Client{
+		AnnounceList: [][]string{{dead}, {dead, second}, {"udp://" + udp.addr()}},
+		InfoHash:     infoHash,
+	}
+	if err := fallback.FindPeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		got  interface{}
+		want interface{}
+	}{
+		"stops at first responding tier": {c.Peers, []string{"10.0.0.1:6881"}},
+		"promotes responding tracker":    {c.AnnounceList[0], []string{first, dead}},
+		"falls back to next tier":        {fallback.Peers, []string{"10.0.0.2:6881", "10.0.0.1:6881"}},
+		"keeps failed tier":              {fallback.AnnounceList[0], []string{dead}},
+		"promotes within later tier":     {fallback.AnnounceList[1], []string{second, dead}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !reflect.DeepEqual(test.got, test.want) {
+				t.Errorf("got %v, wanted %v", test.got, test.want)
+			}
+		})
+	}
+
+	t.Run("fails when no tracker answers", func(t *testing.T) {
+		c := Client{AnnounceList: [][]string{{dead}}, InfoHash: infoHash}
+		if err := c.FindPeers(); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+// fakeUDPTracker is an in-process stand-in for a UDP tracker that knows a
+// single torrent.
+type fakeUDPTracker struct {
+	conn     net.PacketConn
+	infoHash string // torrent the tracker knows
+	peers    string // compact peer list returned on announce
+	drop     int32  // number of packets to ignore, to force retransmissions
+	connects int32  // number of connect requests received
+}
+
+const fakeConnectionID = 0x1234
+
+func startFakeUDPTracker(t *testing.T, infoHash, peers string) *fakeUDPTracker {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	tracker := &fakeUDPTracker{conn: conn, infoHash: infoHash, peers: peers}
+	go tracker.serve()
+	return tracker
+}
+
+func (f *fakeUDPTracker) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if atomic.AddInt32(&f.drop, -1) >= 0 {
+			continue
+		}
+		req := buf[:n]
+		connID := binary.BigEndian.Uint64(req[0:8])
+		action := binary.BigEndian.Uint32(req[8:12])
+
+		reply := binary.BigEndian.AppendUint32(nil, action)
+		reply = append(reply, req[12:16]...) // transaction ID
+
+		switch {
+		case action == udpActionConnect && connID == udpProtocolID:
+			atomic.AddInt32(&f.connects, 1)
+			reply = binary.BigEndian.AppendUint64(reply, fakeConnectionID)
+		case connID != fakeConnectionID:
+			reply = f.error(req, "invalid connection ID")
+		case action == udpActionAnnounce && string(req[16:36]) == f.infoHash:
+			reply = binary.BigEndian.AppendUint32(reply, 1800) // interval
+			reply = binary.BigEndian.AppendUint32(reply, 2)    // leechers
+			reply = binary.BigEndian.AppendUint32(reply, 3)    // seeders
+			reply = append(reply, f.peers...)
+		case action == udpActionScrape:
+			for i := 16; i+20 <= len(req); i += 20 {
+				reply = binary.BigEndian.AppendUint32(reply, 3)  // seeders
+				reply = binary.BigEndian.AppendUint32(reply, 10) // completed
+				reply = binary.BigEndian.AppendUint32(reply, 2)  // leechers
+			}
+		default:
+			reply = f.error(req, "unknown torrent")
+		}
+
+		_, _ = f.conn.WriteTo(reply, addr)
+	}
+}
+
+func (f *fakeUDPTracker) error(req []byte, message string) []byte {
+	reply := binary.BigEndian.AppendUint32(nil, udpActionError)
+	reply = append(reply, req[12:16]...)
+	return append(reply, message...)
+}
+
+func TestChoker(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	seeding := true
+	ch := newChoker(2, func() bool { return seeding })
+	ch.now = func() time.Time { return clock }
+	ch.rechoked = clock
+
+	// Rates below are in bytes per second over a 10 second round.
+	peers := map[string]*fakeChokePeer{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "idle"} {
+		peers[name] = &fakeChokePeer{interested: name != "idle", choked: true}
+		ch.Add(peers[name])
+	}
+	round := func(down, up map[string]int64) {
+		for name, rate := range down {
+			peers[name].downloaded += rate * 10
+		}
+		for name, rate := range up {
+			peers[name].uploaded += rate * 10
+		}
+		clock = clock.Add(rechokeInterval)
+		ch.Rechoke()
+	}
+	unchoked := func() (regular []string, optimistic string) {
+		for name, p := range peers {
+			if p.choked {
+				continue
+			}
+			if p == ch.optimistic {
+				optimistic = name
+			} else {
+				regular = append(regular, name)
+			}
+		}
+		sort.Strings(regular)
+		return regular, optimistic
+	}
+
+	// Seeding ranks peers by how fast we upload to them.
+	round(nil, map[string]int64{"a": 100, "b": 300, "c": 200})
+	regular, first := unchoked()
+	if !reflect.DeepEqual(regular, []string{"b", "c"}) {
+		t.Errorf("unchoked %v while seeding, wanted [b c]", regular)
+	}
+	if first == "" || first == "b" || first == "c" || first == "idle" {
+		t.Errorf("optimistic unchoke went to %q", first)
+	}
+	if !peers["idle"].choked {
+		t.Errorf("uninterested peer was unchoked")
+	}
+
+	// The optimistic unchoke stays for 30 seconds, then rotates.
+	round(nil, map[string]int64{"a": 100, "b": 300, "c": 200})
+	round(nil, map[string]int64{"a": 100, "b": 300, "c": 200})
+	if _, got := unchoked(); got != first {
+		t.Errorf("optimistic unchoke moved from %q to %q within 30 seconds", first, got)
+	}
+	round(nil, map[string]int64{"a": 100, "b": 300, "c": 200})
+	if _, got := unchoked(); got == first || got == "" {
+		t.Errorf("optimistic unchoke stayed on %q after 30 seconds", first)
+	}
+
+	// Peers that report a download rate, which no connection does yet, are
+	// ranked by how fast they send to us unless we are seeding.
+	seeding = false
+	round(map[string]int64{"d": 500, "e": 400, "a": 10}, map[string]int64{"b": 300, "c": 200})
+	if regular, _ := unchoked(); !reflect.DeepEqual(regular, []string{"d", "e"}) {
+		t.Errorf("unchoked %v while downloading, wanted [d e]", regular)
+	}
+
+	// A slot freed by a peer losing interest is filled right away.
+	peers["d"].interested = false
+	ch.Update()
+	if !peers["d"].choked {
+		t.Errorf("peer that lost interest is still unchoked")
+	}
+	if regular, _ := unchoked(); !reflect.DeepEqual(regular, []string{"a", "e"}) {
+		t.Errorf("unchoked %v after d lost interest, wanted [a e]", regular)
+	}
+}
+
+func TestChokerSlowPeer(t *testing.T) {
+	ch := newChoker(2, func() bool { return true })
+	slow := &fakeChokePeer{interested: true, choked: true, block: make(chan struct{})}
+	ch.Add(slow)
+
+	// The slow peer takes its time to accept the unchoke.
+	updated := make(chan struct{})
+	go func() {
+		ch.Update()
+		close(updated)
+	}()
+
+	added := make(chan struct{})
+	go func() {
+		ch.Add(&fakeChokePeer{choked: true})
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Errorf("adding a peer waited for the slow peer")
+	}
+
+	close(slow.block)
+	<-updated
+	if slow.choked {
+		t.Errorf("slow peer was not unchoked")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	seeder, data := newTestClient(t, 100000, 16384)
+
+	// Corrupt piece 2 on disk so the seeder does not offer it.
+	onDisk := append([]byte{}, data...)
+	onDisk[2*16384] ^= 0xff
+	dataPath := filepath.Join(t.TempDir(), "test.bin")
+	if err := os.WriteFile(dataPath, onDisk, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	root, files := seeder.outputFiles(dataPath)
+	reader, err := openFileStorage(root, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	seeder.Have = seeder.verifyPieces(reader)
+
+	if got, want := seeder.Have.Count(), len(seeder.PieceHashes)-1; got != want {
+		t.Errorf("seeder has %d pieces, wanted %d", got, want)
+	}
+	if seeder.Have.Has(2) {
+		t.Errorf("seeder offers corrupted piece 2")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { _ = seeder.serve(ln, reader) }()
+
+	leecher := seeder
+	leecher.PeerID = testPeerID
+	leecher.Have = nil
+	leecher.Peers = []string{ln.Addr().String()}
+	got := make([]byte, len(data))
+	err = leecher.downloadPieces([]int{0, 1, 3, 4, 5, 6}, func(index int, piece []byte) error {
+		copy(got[index*leecher.Info.PieceLength:], piece)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 1, 3, 4, 5, 6} {
+		begin := i * leecher.Info.PieceLength
+		end := begin + leecher.pieceLength(i)
+		if !bytes.Equal(got[begin:end], data[begin:end]) {
+			t.Errorf("piece %d does not match", i)
+		}
+	}
+}
+
+func TestSeedFast(t *testing.T) {
+	seeder, data := newTestClient(t, 20*1024, 1024)
+	storage := NewMemoryStorage(len(data))
+	if _, err := storage.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	seeder.Have = seeder.verifyPieces(storage)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { _ = seeder.serve(ln, storage) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := Handshake(conn, seeder.InfoHash, testPeerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Fast {
+		t.Fatalf("seeder does not support the Fast Extension")
+	}
+
+	// A complete seeder announces have all, then our allowed fast set. Its
+	// extended handshake is skipped.
+	readNext := func() interface{} {
+		t.Helper()
+		for {
+			raw, err := readMessage(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := decodeMessage(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := msg.(extendedMsg); !ok {
+				return msg
+			}
+		}
+	}
+	if msg := readNext(); msg != (haveAllMsg{}) {
+		t.Fatalf("got %#v, wanted have all", msg)
+	}
+	want := allowedFastSet(net.ParseIP("127.0.0.1"), seeder.InfoHash, len(seeder.PieceHashes), allowedFastCount)
+	allowed := map[int]bool{}
+	for range want {
+		msg, ok := readNext().(allowedFastMsg)
+		if !ok {
+			t.Fatalf("got %#v, wanted allowed fast", msg)
+		}
+		allowed[msg.index] = true
+	}
+	for _, index := range want {
+		if !allowed[index] {
+			t.Errorf("piece %d of the allowed fast set not announced", index)
+		}
+	}
+
+	// While choked, requests outside the allowed fast set are rejected and
+	// the others are served.
+	notAllowed := 0
+	for allowed[notAllowed] {
+		notAllowed++
+	}
+	r := blockRequest{index: notAllowed, offset: 0, length: 1024}
+	if err := sendRequest(conn, r.index, r.offset, r.length); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readNext(); !reflect.DeepEqual(msg, rejectMsg{r}) {
+		t.Errorf("got %#v, wanted %#v", msg, rejectMsg{r})
+	}
+
+	if err := sendRequest(conn, want[0], 0, 1024); err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := readNext().(pieceMsg)
+	if !ok || msg.index != want[0] || !bytes.Equal(msg.block, data[want[0]*1024:(want[0]+1)*1024]) {
+		t.Errorf("got %#v, wanted piece %d", msg, want[0])
+	}
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	c, data := newTestClient(t, 100000, 16384)
+
+	tests := map[string]struct {
+		existing []byte   // contents of the output file before the download
+		peers    []string // nil when nothing should need downloading
+	}{
+		"fresh download":          {nil, []string{startFakePeer(t, &c, data, fakeSeeder)}},
+		"output already complete": {data, nil},
+		"resumes partial output": {
+			append(append([]byte{}, data[:3*16384]...), make([]byte, 5000)...),
+			[]string{startFakePeer(t, &c, data, fakeSeeder)},
+		},
+		"replaces corrupt pieces and truncates": {
+			append(append([]byte{1, 2, 3}, data[3:]...), 9, 9, 9),
+			[]string{startFakePeer(t, &c, data, fakeSeeder)},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "test.bin")
+			if test.existing != nil {
+				if err := os.WriteFile(outputPath, test.existing, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := c
+			c.Peers = test.peers
+			if err := c.DownloadFile(outputPath); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("output does not match")
+			}
+			if c.left() != 0 {
+				t.Errorf("%d bytes left after download", c.left())
+			}
+		})
+	}
+}
+
+// pipePeer returns a connection over an in-memory pipe to a peer that has all
+// pieces pieces and has unchoked us, the peer's end of the pipe, and the messages
+// the peer receives.
+func pipePeer(t *testing.T, pieces int) (*peerConn, net.Conn, <-chan Message) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	pc := newPeerConn(conn, "pipe", pieces)
+	for i := 0; i < pieces; i++ {
+		pc.has.Set(i)
+	}
+	pc.amInterested = true
+	pc.peerChoking = false
+	t.Cleanup(func() {
+		pc.Close()
+		peer.Close()
+	})
+
+	received := make(chan Message, 100)
+	go func() {
+		for {
+			msg, err := readMessage(peer)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	return pc, peer, received
+}
+
+// fakeChokePeer is a peer for testing the choker.
+type fakeChokePeer struct {
+	interested           bool
+	downloaded, uploaded int64
+	choked               bool
+	block                chan struct{} // SetChoked waits for it to close, unless nil
+}
+
+func (p *fakeChokePeer) Interested() bool            { return p.interested }
+func (p *fakeChokePeer) Transferred() (int64, int64) { return p.downloaded, p.uploaded }
+func (p *fakeChokePeer) Choked() bool                { return p.choked }
+func (p *fakeChokePeer) SetChoked(choked bool) error {
+	if p.block != nil {
+		<-p.block
+	}
+	p.choked = choked
+	return nil
+}
+
+// fakePeerMode controls how a fake peer behaves.
+type fakePeerMode int
+
+const (
+	fakeSeeder fakePeerMode = iota // has every piece and serves them
+	fakeBroken                     // has every piece but hangs up on the first request
+	fakeEmpty                      // has no pieces
+	fakeChatty                     // announces pieces with have messages and sends extra messages
+)
+
+// newTestClient returns a client for a torrent of random data with the given
+// length and piece length, along with the data itself.
+func newTestClient(t *testing.T, length, pieceLength int) (Client, []byte) {
+	t.Helper()
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	pieces := ""
+	for i := 0; i < length; i += pieceLength {
+		end := i + pieceLength
+		if end > length {
+			end = length
+		}
+		h := sha1.Sum(data[i:end])
+		pieces += string(h[:])
+	}
+
+	info := &bytes.Buffer{}
+	err := bencode.Marshal(info, TorrentInfo{
+		Length:      length,
+		Name:        "test.bin",
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Client{InfoHash: hashInfo(info.String())}
+	if err := c.loadInfo(info.String()); err != nil {
+		t.Fatal(err)
+	}
+	return c, data
+}
+
+// startFakePeer starts a peer on the loopback interface that serves data for
+// the torrent described by c, and returns its address.
+func startFakePeer(t *testing.T, c *Client, data []byte, mode fakePeerMode) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakePeer(conn, c, data, mode)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// Peer ID of the fake peers, which must differ from ours.
+const testPeerID = "-TS0001-0123456789ab"
+
+// Extended message ID the fake peer assigns to ut_metadata.
+const fakeUtMetadata = 3
+
+func serveFakePeer(conn net.Conn, c *Client, data []byte, mode fakePeerMode) {
+	defer conn.Close()
+
+	hs := make([]byte, 68)
+	if _, err := io.ReadFull(conn, hs); err != nil {
+		return
+	}
+	reply := newHandshakeMessage(c.InfoHash, testPeerID)
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+
+	bitfield := make([]byte, (len(c.PieceHashes)+7)/8)
+	if mode != fakeEmpty {
+		for i := range c.PieceHashes {
+			bitfield[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	if mode == fakeChatty {
+		// Skip the bitfield, which is optional, and announce every piece
+		// after a keep-alive.
+		_, _ = conn.Write([]byte{0, 0, 0, 0})
+		for i := range c.PieceHashes {
+			have := binary.BigEndian.AppendUint32(nil, uint32(i))
+			_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgHave}, Payload: have})
+		}
+	} else {
+		_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgBitfield}, Payload: bitfield})
+	}
+
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+
+		switch msg.Header.Type {
+		case msgInterested:
+			err = sendMessage(conn, Message{Header: MessageHeader{Type: msgUnchoke}})
+		case msgRequest:
+			if mode == fakeBroken {
+				return
+			}
+			index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+			offset := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+			length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+			if mode == fakeChatty {
+				// Interleave messages the downloader does not wait for.
+				_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgNotInterested}})
+				_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgExtended}, Payload: []byte{7, 'x'}})
+				_ = sendMessage(conn, Message{Header: MessageHeader{Type: 99}})
+				_ = sendMessage(conn, Message{Header: MessageHeader{Type: msgUnchoke}})
+			}
+			begin := index*c.Info.PieceLength + offset
+			payload := append([]byte{}, msg.Payload[0:8]...)
+			payload = append(payload, data[begin:begin+length]...)
+			err = sendMessage(conn, Message{Header: MessageHeader{Type: msgPiece}, Payload: payload})
+		case msgExtended:
+			err = serveFakeExtended(conn, c, msg.Payload)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serveFakeExtended answers the extended handshake and ut_metadata requests.
+func serveFakeExtended(conn net.Conn, c *Client, payload []byte) error {
+	switch payload[0] {
+	case extHandshake:
+		return sendExtendedMessage(conn, extHandshake, ExtendedHandshake{
+			M:            map[string]int{"ut_metadata": fakeUtMetadata},
+			MetadataSize: len(c.RawInfo),
+		})
+	case fakeUtMetadata:
+		req, _, err := parseMetadataMessage(payload[1:])
+		if err != nil {
+			return err
+		}
+		begin := req.Piece * metadataPieceLength
+		end := begin + metadataPieceLength
+		if end > len(c.RawInfo) {
+			end = len(c.RawInfo)
+		}
+		reply := MetadataMessage{MsgType: metadataData, Piece: req.Piece, TotalSize: len(c.RawInfo)}
+		return sendExtendedMessage(conn, extUtMetadata, reply, []byte(c.RawInfo[begin:end])...)
+	}
+	return nil
+}
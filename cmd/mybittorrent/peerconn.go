@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long to wait on a peer before giving up on it.
+const peerTimeout = 30 * time.Second
+
+// peerConn is an open connection to a peer. Once connected, messages from the
+// peer are read and decoded in the background and delivered on messages, so
+// the downloader can wait for a block and for other events at the same time.
+//
+// The state of the peer is updated by handle, which the goroutine consuming
+// messages calls for each of them, so only that goroutine touches it.
+type peerConn struct {
+	conn     net.Conn         // TCP connection to the peer
+	addr     string           // ip_address:port of the peer
+	messages chan interface{} // decoded messages received from the peer
+
+	peerState
+	pieces      int                   // number of pieces in the torrent
+	fast        bool                  // whether the Fast Extension is enabled
+	extended    bool                  // whether the extension protocol is enabled
+	ext         ExtendedHandshake     // the peer's extended handshake, once received
+	rawInfo     string                // info dictionary served with ut_metadata, empty if unknown
+	has         Bitfield              // pieces the peer has
+	refused     Bitfield              // pieces the peer rejected requests for while unchoking us
+	allowedFast map[int]bool          // pieces we may request while choked
+	suggested   []int                 // pieces the peer suggested, oldest first
+	pending     map[blockRequest]bool // requests sent and not answered yet
+	handled     int                   // messages handled, apart from keep-alives and extended messages
+	chokedSince time.Time             // when the peer started keeping us choked while interested
+	onHave      func(index int)       // called for each piece announced by a have message, may be nil
+	onBitfield  func(has Bitfield)    // called with has once the bitfield or have all arrives, may be nil
+
+	onPeers func(added []pexPeer, dropped []string) // called for each ut_pex message, may be nil
+	pexSent map[string]bool                         // peers we told the peer about with ut_pex
+	pexNext time.Time                               // when the next ut_pex message may be sent
+
+	err       error         // why reading stopped, set before messages is closed
+	closed    chan struct{} // closed by Close to stop reading
+	closeOnce sync.Once
+}
+
+// peerState is the choke and interest state of both ends of a connection, as
+// described in BEP 3. A connection starts out choked and not interested in
+// both directions. Blocks are only requested while the other end is not
+// choking and is told we are interested.
+type peerState struct {
+	amChoking      bool // we are choking the peer
+	amInterested   bool // we told the peer we are interested in its pieces
+	peerChoking    bool // the peer is choking us
+	peerInterested bool // the peer is interested in our pieces
+}
+
+// newPeerState returns the state of a new connection.
+func newPeerState() peerState {
+	return peerState{amChoking: true, peerChoking: true}
+}
+
+// update applies a choke or interest message from the peer. It returns false
+// for any other message.
+func (s *peerState) update(msg interface{}) bool {
+	switch msg.(type) {
+	case chokeMsg:
+		s.peerChoking = true
+	case unchokeMsg:
+		s.peerChoking = false
+	case interestedMsg:
+		s.peerInterested = true
+	case notInterestedMsg:
+		s.peerInterested = false
+	default:
+		return false
+	}
+	return true
+}
+
+// pieceWork is a piece handed to a peer for download.
+type pieceWork struct {
+	index    int             // piece index
+	hash     string          // expected SHA-1 hash of the piece in hex
+	length   int             // length of the piece in bytes
+	finished <-chan struct{} // closed once the piece is saved, may be nil
+}
+
+// pieceResult is a downloaded piece that passed its hash check.
+type pieceResult struct {
+	index int    // piece index
+	data  []byte // contents of the piece
+}
+
+// dialPeer connects to the peer at addr and runs the handshake. The peer's
+// bitfield and unchoke arrive later as messages.
+func (c *Client) dialPeer(addr string) (*peerConn, error) {
+	logger.Debug("Connecting to peer at %s...\n", addr)
+	conn, err := net.DialTimeout("tcp", addr, peerTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(peerTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	peer, err := Handshake(conn, c.InfoHash, c.peerID())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	logger.Info("Connected to peer at %s running %s.\n", addr, identifyClient(peer.PeerID))
+
+	// From now on a quiet peer is detected by the downloader, which knows
+	// whether it is waiting for anything.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pc := newPeerConn(conn, addr, len(c.PieceHashes))
+	pc.fast = peer.Fast
+	pc.extended = peer.Extended
+	pc.rawInfo = c.RawInfo
+	if pc.extended {
+		ours := ourExtendedHandshake(len(c.RawInfo), c.Info.IsPrivate())
+		if err := sendExtendedMessage(conn, extHandshake, ours); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
+}
+
+// newPeerConn wraps a connection that has completed the handshake for a
+// torrent of pieces pieces and starts reading messages from it. The peer
+// starts out with no pieces.
+func newPeerConn(conn net.Conn, addr string, pieces int) *peerConn {
+	pc := &peerConn{
+		conn:        conn,
+		addr:        addr,
+		messages:    make(chan interface{}),
+		peerState:   newPeerState(),
+		pieces:      pieces,
+		has:         newBitfield(pieces),
+		refused:     newBitfield(pieces),
+		allowedFast: map[int]bool{},
+		pending:     map[blockRequest]bool{},
+		closed:      make(chan struct{}),
+	}
+	go pc.readLoop()
+	return pc
+}
+
+// readLoop delivers messages from the peer until the connection fails or is
+// closed.
+func (pc *peerConn) readLoop() {
+	defer close(pc.messages)
+	for {
+		raw, err := readMessage(pc.conn)
+		if err != nil {
+			pc.err = err
+			return
+		}
+		msg, err := decodeMessage(raw)
+		if err != nil {
+			pc.err = err
+			return
+		}
+		select {
+		case pc.messages <- msg:
+		case <-pc.closed:
+			pc.err = net.ErrClosed
+			return
+		}
+	}
+}
+
+// handle updates the state of the peer for a message it sent. It fails if
+// the message breaks the protocol.
+func (pc *peerConn) handle(msg interface{}) error {
+	switch msg.(type) {
+	case keepAliveMsg:
+		return nil
+	case extendedMsg:
+		// The extended handshake may come before the bitfield.
+	default:
+		pc.handled++
+	}
+
+	if pc.update(msg) {
+		logger.Debug("Peer %s state: %+v.\n", pc.addr, pc.peerState)
+		if !pc.peerChoking {
+			pc.chokedSince = time.Time{}
+		}
+		if pc.peerChoking && !pc.fast {
+			// The peer drops the requests it has not answered yet. With the
+			// Fast Extension it rejects each of them instead.
+			pc.pending = map[blockRequest]bool{}
+		}
+		return nil
+	}
+
+	switch msg.(type) {
+	case haveAllMsg, haveNoneMsg, suggestMsg, allowedFastMsg, rejectMsg:
+		if !pc.fast {
+			return fmt.Errorf("fast extension message %T without the extension", msg)
+		}
+	}
+
+	switch m := msg.(type) {
+	case haveMsg:
+		if !pc.validPiece(m.index) {
+			return fmt.Errorf("peer has piece %d, which is out of range", m.index)
+		}
+		pc.addPiece(m.index)
+	case bitfieldMsg:
+		if pc.handled > 1 {
+			return fmt.Errorf("bitfield received after other messages")
+		}
+		if len(m.bitfield) != len(pc.has) {
+			return fmt.Errorf("bitfield of %d bytes, expected %d", len(m.bitfield), len(pc.has))
+		}
+		for i := 0; pc.validPiece(i); i++ {
+			if m.bitfield.Has(i) {
+				pc.has.Set(i)
+			}
+		}
+		if pc.onBitfield != nil {
+			pc.onBitfield(pc.has)
+		}
+	case haveAllMsg:
+		if pc.handled > 1 {
+			return fmt.Errorf("have all received after other messages")
+		}
+		for i := 0; pc.validPiece(i); i++ {
+			pc.has.Set(i)
+		}
+		if pc.onBitfield != nil {
+			pc.onBitfield(pc.has)
+		}
+	case haveNoneMsg:
+		if pc.handled > 1 {
+			return fmt.Errorf("have none received after other messages")
+		}
+	case suggestMsg:
+		if pc.validPiece(m.index) {
+			pc.suggested = append(pc.suggested, m.index)
+			if len(pc.suggested) > maxSuggestedPieces {
+				pc.suggested = pc.suggested[1:]
+			}
+		}
+	case allowedFastMsg:
+		// The peer may allow pieces it does not have yet; they become
+		// useful once it announces them.
+		if pc.validPiece(m.index) {
+			pc.allowedFast[m.index] = true
+		}
+	case rejectMsg:
+		delete(pc.pending, m.blockRequest)
+	case extendedMsg:
+		return pc.handleExtended(m)
+	case unknownMsg:
+		logger.Debug("Ignoring message of type %d from %s.\n", m.msgType, pc.addr)
+	}
+	return nil
+}
+
+// handleExtended records the peer's extended handshake and passes the
+// messages of each extension to its handler.
+func (pc *peerConn) handleExtended(m extendedMsg) error {
+	if !pc.extended {
+		return fmt.Errorf("extended message without the extension protocol")
+	}
+	if m.id == extHandshake {
+		h, err := parseExtendedHandshake(m.payload)
+		if err != nil {
+			return err
+		}
+		// Later handshakes only update what they mention.
+		if pc.ext.M == nil {
+			pc.ext.M = map[string]int{}
+		}
+		for name, id := range h.M {
+			pc.ext.M[name] = id
+		}
+		if h.V != "" {
+			pc.ext.V = h.V
+		}
+		if h.MetadataSize > 0 {
+			pc.ext.MetadataSize = h.MetadataSize
+		}
+		if h.Reqq > 0 {
+			pc.ext.Reqq = h.Reqq
+		}
+		logger.Debug("Peer %s extended handshake: %+v.\n", pc.addr, pc.ext)
+		return nil
+	}
+
+	e, ok := extensions[m.id]
+	if !ok || e.handle == nil {
+		logger.Debug("Ignoring extended message %d from %s.\n", m.id, pc.addr)
+		return nil
+	}
+	return e.handle(pc, m.payload)
+}
+
+// validPiece reports whether index is a piece of the torrent.
+func (pc *peerConn) validPiece(index int) bool {
+	return index >= 0 && index < pc.pieces
+}
+
+// available returns the pieces the peer has and has not refused to send us.
+func (pc *peerConn) available() Bitfield {
+	available := make(Bitfield, len(pc.has))
+	for i := range available {
+		available[i] = pc.has[i] &^ pc.refused[i]
+	}
+	return available
+}
+
+// allowedFastPieces returns the pieces we may request while choked, in order.
+func (pc *peerConn) allowedFastPieces() []int {
+	pieces := make([]int, 0, len(pc.allowedFast))
+	for i := range pc.allowedFast {
+		pieces = append(pieces, i)
+	}
+	sort.Ints(pieces)
+	return pieces
+}
+
+// addPiece records that the peer has the piece at index.
+func (pc *peerConn) addPiece(index int) {
+	if pc.has.Has(index) {
+		return
+	}
+	pc.has.Set(index)
+	if pc.onHave != nil {
+		pc.onHave(index)
+	}
+}
+
+// setInterested tells the peer whether we are interested in its pieces, if
+// that has changed.
+func (pc *peerConn) setInterested(interested bool) error {
+	if interested == pc.amInterested {
+		return nil
+	}
+	msgType := msgNotInterested
+	if interested {
+		msgType = msgInterested
+	}
+	if err := pc.refreshWriteDeadline(); err != nil {
+		return err
+	}
+	if err := sendMessage(pc.conn, Message{Header: MessageHeader{Type: msgType}}); err != nil {
+		return err
+	}
+	pc.amInterested = interested
+	if !interested {
+		pc.chokedSince = time.Time{}
+	}
+	return nil
+}
+
+// pendingRequests returns the requests the peer has not answered yet, in
+// order.
+func (pc *peerConn) pendingRequests() []blockRequest {
+	requests := make([]blockRequest, 0, len(pc.pending))
+	for r := range pc.pending {
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].index != requests[j].index {
+			return requests[i].index < requests[j].index
+		}
+		return requests[i].offset < requests[j].offset
+	})
+	return requests
+}
+
+// request asks the peer for a block and records it as pending.
+func (pc *peerConn) request(r blockRequest) error {
+	if err := pc.refreshWriteDeadline(); err != nil {
+		return err
+	}
+	if err := sendRequest(pc.conn, r.index, r.offset, r.length); err != nil {
+		return err
+	}
+	pc.pending[r] = true
+	return nil
+}
+
+// cancel withdraws a pending request.
+func (pc *peerConn) cancel(r blockRequest) error {
+	delete(pc.pending, r)
+	if err := pc.refreshWriteDeadline(); err != nil {
+		return err
+	}
+	return sendCancel(pc.conn, r.index, r.offset, r.length)
+}
+
+// unchokeTimeout returns a channel that fires once the peer has kept us
+// choked for peerTimeout while we are interested, or nil if it is not doing
+// so. The wait starts when the choke is first seen, and messages that leave
+// the peer choking do not restart it.
+func (pc *peerConn) unchokeTimeout() <-chan time.Time {
+	if !pc.amInterested || !pc.peerChoking {
+		pc.chokedSince = time.Time{}
+		return nil
+	}
+	if pc.chokedSince.IsZero() {
+		pc.chokedSince = time.Now()
+	}
+	return time.After(time.Until(pc.chokedSince.Add(peerTimeout)))
+}
+
+// cancelPending withdraws every pending request. They are forgotten even if
+// the cancel messages cannot be sent.
+func (pc *peerConn) cancelPending() error {
+	var err error
+	for _, r := range pc.pendingRequests() {
+		if cerr := pc.cancel(r); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// refreshWriteDeadline gives the next write peerTimeout to complete. It is
+// called before each write, so a peer that stops reading is dropped while a
+// piece that takes long to arrive is not.
+func (pc *peerConn) refreshWriteDeadline() error {
+	return pc.conn.SetWriteDeadline(time.Now().Add(peerTimeout))
+}
+
+// received records the answer to a request. It returns false if the block
+// was not requested, or the request was cancelled.
+func (pc *peerConn) received(m pieceMsg) bool {
+	r := blockRequest{index: m.index, offset: m.offset, length: len(m.block)}
+	if !pc.pending[r] {
+		return false
+	}
+	delete(pc.pending, r)
+	return true
+}
+
+// Close closes the connection to the peer.
+func (pc *peerConn) Close() error {
+	err := net.ErrClosed
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+		err = pc.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// azureusClients maps the two-letter codes of Azureus-style peer IDs, such
+// as "-qB4520-", to the client using them.
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GO": "mybittorrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rasterbar)",
+	"lt": "libTorrent (rakshasa)",
+	"qB": "qBittorrent",
+	"RT": "rTorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "µTorrent for Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the first letter of Shadow-style peer IDs, such as
+// "S58B-----", to the client using them.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigits are the characters of Shadow-style versions, each standing for
+// its index.
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// identifyClient returns the name and version of the client that generated
+// peerID, or "unknown" if the ID does not follow a convention we know.
+func identifyClient(peerID string) string {
+	if name, version, ok := parseAzureusID(peerID); ok {
+		return name + " " + version
+	}
+	if name, version, ok := parseMainlineID(peerID); ok {
+		return name + " " + version
+	}
+	if name, version, ok := parseShadowID(peerID); ok {
+		return name + " " + version
+	}
+	if strings.HasPrefix(peerID, "exbc") && len(peerID) >= 6 {
+		return fmt.Sprintf("BitComet %d.%02d", peerID[4], peerID[5])
+	}
+	return "unknown"
+}
+
+// parseAzureusID decodes an ID starting with a dash, a two-letter client
+// code, four version characters and another dash. Clients with a code we do
+// not know are named by their code.
+func parseAzureusID(peerID string) (name, version string, ok bool) {
+	if len(peerID) < 8 || peerID[0] != '-' || peerID[7] != '-' {
+		return "", "", false
+	}
+	code := peerID[1:3]
+	digits := []int{}
+	for i := 3; i < 7; i++ {
+		d := strings.IndexByte(shadowDigits[:36], peerID[i])
+		if d < 0 {
+			return "", "", false
+		}
+		digits = append(digits, d)
+	}
+
+	name, known := azureusClients[code]
+	if !known {
+		name = code
+	}
+	if code == "TR" {
+		// Transmission puts the major version first and the minor version,
+		// always two digits, after it.
+		return name, fmt.Sprintf("%d.%d%d", digits[0], digits[1], digits[2]), true
+	}
+	return name, dottedVersion(digits), true
+}
+
+// parseMainlineID decodes an ID of the original BitTorrent client, such as
+// "M7-4-0--": an M followed by the version numbers, each followed by a dash.
+func parseMainlineID(peerID string) (name, version string, ok bool) {
+	if len(peerID) < 8 || peerID[0] != 'M' {
+		return "", "", false
+	}
+	parts := strings.Split(peerID[1:8], "-")
+	if len(parts) < 4 {
+		return "", "", false
+	}
+	for _, p := range parts[:3] {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return "", "", false
+		}
+	}
+	return "BitTorrent", strings.Join(parts[:3], "."), true
+}
+
+// parseShadowID decodes an ID of a client letter followed by up to five
+// version characters and at least two dashes, such as "S58B-----".
+func parseShadowID(peerID string) (name, version string, ok bool) {
+	if len(peerID) < 4 {
+		return "", "", false
+	}
+	name, ok = shadowClients[peerID[0]]
+	if !ok {
+		return "", "", false
+	}
+	end := strings.Index(peerID[1:], "--") + 1
+	if end < 2 || end > 6 {
+		return "", "", false
+	}
+	digits := []int{}
+	for i := 1; i < end; i++ {
+		d := strings.IndexByte(shadowDigits[:len(shadowDigits)-1], peerID[i])
+		if d < 0 {
+			return "", "", false
+		}
+		digits = append(digits, d)
+	}
+	return name, dottedVersion(digits), true
+}
+
+// dottedVersion joins version numbers with dots, leaving out trailing zeros
+// beyond the minor version.
+func dottedVersion(digits []int) string {
+	for len(digits) > 2 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	parts := make([]string, len(digits))
+	for i, d := range digits {
+		parts[i] = fmt.Sprint(d)
+	}
+	return strings.Join(parts, ".")
+}
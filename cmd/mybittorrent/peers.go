@@ -3,83 +3,362 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
-const PeerID = "00112233445566778899" // Peer ID used for this client (20 bytes)
+const defaultPort = 6881 // Port we listen on and announce to trackers unless the client sets one
+
+// trackerTimeout is how long we wait for a tracker before trying the next.
+const trackerTimeout = 30 * time.Second
+
+// trackerClient is the HTTP client for announces and scrapes.
+var trackerClient = &http.Client{Timeout: trackerTimeout}
 
 type GetPeersResponse struct {
-	Complete    int    `bencode:"complete"`
-	Incomplete  int    `bencode:"incomplete"`
-	Interval    int    `bencode:"interval"`
-	MinInterval int    `bencode:"min interval"`
-	Peers       string `bencode:"peers"`
+	Complete      int    `bencode:"complete"`
+	Incomplete    int    `bencode:"incomplete"`
+	Interval      int    `bencode:"interval"`
+	MinInterval   int    `bencode:"min interval"`
+	Peers         string `bencode:"peers"`
+	FailureReason string `bencode:"failure reason"`
 }
 
+// Peer is the handshake of a peer, along with the capabilities advertised by
+// its reserved bytes.
 type Peer struct {
 	Protocol string // should be "BitTorrent protocol"
-	Reserved []byte // should be {0, 0, 0, 0, 0, 0, 0, 0}
+	Reserved []byte // bits advertising protocol extensions
 	InfoHash string // SHA-1 hash of torrent file info
 	PeerID   string // ID of the peer
+	Fast     bool   // whether the Fast Extension (BEP 6) is enabled
+	Extended bool   // whether the extension protocol (BEP 10) is supported
 }
 
-// peerList discovers peers and adds their IP addresses to the Peers
-// field of the Client struct.
-func (c *Client) peerList() error {
+// FindPeers discovers peers from the trackers of the torrent and adds their IP
+// addresses to the Peers field of the Client struct. Tiers are tried in order
+// as BEP 12 specifies: the next tier is only announced to once every tracker
+// of the ones before it has failed, and within a tier trackers are tried one
+// after the other. The peers of the tracker that responds are merged with
+// those from the DHT if the client has a DHT node and the torrent is not
+// private.
+func (c *Client) FindPeers() error {
 	peers := []string{}
-	pr, err := c.discoverPeers()
-	if err != nil {
-		return err
+	var lastErr error
+	responded := false
+
+	for _, tier := range c.trackerTiers() {
+		found, err := c.announceTier(tier)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		peers = append(peers, found...)
+		responded = true
+		break
+	}
+
+	if c.DHT != nil && !c.Info.IsPrivate() {
+		found, err := c.dhtPeers()
+		if err != nil {
+			logger.Warning("DHT lookup failed: %v\n", err)
+			lastErr = err
+		} else {
+			logger.Debug("DHT returned %d peers.\n", len(found))
+			peers = append(peers, found...)
+			responded = true
+		}
 	}
 
-	for i := 0; i < len(pr.Peers); i += 6 {
-		peer := pr.Peers[i : i+6]
+	if !responded {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("torrent has no trackers")
+		}
+		return lastErr
+	}
+
+	c.Peers = uniquePeers(peers)
+
+	return nil
+}
+
+// announceTier tries the trackers of tier one after the other and returns the
+// peers of the first one to respond, which is moved to the front of its tier.
+func (c *Client) announceTier(tier []string) ([]string, error) {
+	var lastErr error
+	for i, tracker := range tier {
+		pr, err := c.discoverPeers(tracker)
+		if err != nil {
+			logger.Warning("Tracker %s failed: %v\n", tracker, err)
+			lastErr = err
+			continue
+		}
+		logger.Debug("Tracker %s returned %d peers.\n", tracker, len(pr.Peers)/6)
+
+		// Promote the tracker that responded.
+		copy(tier[1:i+1], tier[:i])
+		tier[0] = tracker
+		return parseCompactPeers(pr.Peers), nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("empty tracker tier")
+	}
+	return nil, lastErr
+}
+
+// trackerTiers returns the tiers of tracker URLs to announce to. Without an
+// announce-list the announce URL is the only tier.
+func (c *Client) trackerTiers() [][]string {
+	if len(c.AnnounceList) > 0 {
+		return c.AnnounceList
+	}
+	if c.Announce != "" {
+		return [][]string{{c.Announce}}
+	}
+	return nil
+}
+
+// shuffleTiers randomizes the order of the trackers within each tier, as
+// BEP 12 asks clients to do when they load a torrent.
+func (c *Client) shuffleTiers() {
+	for _, tier := range c.AnnounceList {
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+	}
+}
+
+// dhtPeers joins the DHT through the nodes listed in the torrent, announces
+// the torrent to it and returns the peers it knows.
+func (c *Client) dhtPeers() ([]string, error) {
+	if err := c.DHT.Bootstrap(c.dhtNodes()); err != nil {
+		return nil, err
+	}
+	return c.DHT.Announce(c.InfoHash, c.port())
+}
+
+// dhtNodes returns the ip_address:port of the DHT nodes listed in the torrent,
+// skipping entries that are not a [host, port] pair.
+func (c *Client) dhtNodes() []string {
+	addrs := []string{}
+	for _, pair := range c.Nodes {
+		if len(pair) != 2 {
+			continue
+		}
+		host, ok := pair[0].(string)
+		port, ok2 := pair[1].(int64)
+		if !ok || !ok2 {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return addrs
+}
+
+// parseCompactPeers converts a compact peer list, 6 bytes per peer, into
+// ip_address:port strings.
+func parseCompactPeers(compact string) []string {
+	peers := []string{}
+	for i := 0; i+6 <= len(compact); i += 6 {
+		peer := compact[i : i+6]
 		ip := peer[:4]
 		portStr := []byte(peer[4:6])
 		port := binary.BigEndian.Uint16(portStr)
 		peerStr := fmt.Sprintf("%d.%d.%d.%d:%d", ip[0], ip[1], ip[2], ip[3], port)
 		peers = append(peers, peerStr)
 	}
+	return peers
+}
+
+// parseCompactPeers6 converts a compact IPv6 peer list, 18 bytes per peer,
+// into [ip_address]:port strings.
+func parseCompactPeers6(compact string) []string {
+	peers := []string{}
+	for i := 0; i+18 <= len(compact); i += 18 {
+		ip := net.IP(compact[i : i+16])
+		port := binary.BigEndian.Uint16([]byte(compact[i+16 : i+18]))
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peers
+}
 
-	c.Peers = peers
+// compactPeers converts ip_address:port strings into compact IPv4 and IPv6
+// peer lists. Addresses that cannot be parsed are left out.
+func compactPeers(addrs []string) (v4, v6 string) {
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if ip == nil || err != nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 += string(binary.BigEndian.AppendUint16(ip4, uint16(port)))
+		} else {
+			v6 += string(binary.BigEndian.AppendUint16(ip.To16(), uint16(port)))
+		}
+	}
+	return v4, v6
+}
 
-	return nil
+// discoverPeers gets a list of peers from the tracker, using the HTTP or the
+// UDP tracker protocol depending on the scheme of its URL.
+func (c *Client) discoverPeers(tracker string) (GetPeersResponse, error) {
+	addr, err := url.Parse(tracker)
+	if err != nil {
+		return GetPeersResponse{}, err
+	}
+
+	switch addr.Scheme {
+	case "http", "https":
+		return c.discoverPeersHTTP(tracker)
+	case "udp":
+		return udpTrackerFor(addr.Host).Announce(c.InfoHash, c.peerID(), c.left(), c.port())
+	default:
+		return GetPeersResponse{}, fmt.Errorf("unsupported tracker URL %q", tracker)
+	}
 }
 
-// discoverPeers gets a list of peers from the announce URL.
-func (c *Client) discoverPeers() (GetPeersResponse, error) {
+// discoverPeersHTTP announces to an HTTP tracker.
+func (c *Client) discoverPeersHTTP(tracker string) (GetPeersResponse, error) {
 	peerResp := GetPeersResponse{}
 
-	addr, err := peerRequestURL(c.Announce, c.InfoHash, c.Info.Length)
+	addr, err := peerRequestURL(tracker, c.InfoHash, c.peerID(), c.left(), c.port())
 	if err != nil {
-		logger.Error(err.Error())
 		return peerResp, err
 	}
 
-	res, err := http.Get(addr)
+	res, err := trackerClient.Get(addr)
 	if err != nil {
-		logger.Error(err.Error())
 		return peerResp, err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		logger.Error("Response code %d received.\n", res.StatusCode)
-		return peerResp, err
+		return peerResp, fmt.Errorf("tracker responded with status %d", res.StatusCode)
 	}
 
 	err = bencode.Unmarshal(res.Body, &peerResp)
 	if err != nil {
-		logger.Error(err.Error())
 		return peerResp, err
 	}
-	res.Body.Close()
+	if peerResp.FailureReason != "" {
+		return peerResp, fmt.Errorf("tracker error: %s", peerResp.FailureReason)
+	}
 
 	return peerResp, nil
 }
 
-func peerRequestURL(rawURL string, infoHash string, infoLength int) (string, error) {
+// Scrape asks the first tracker for the number of seeders, leechers and
+// completed downloads of the torrent.
+func (c *Client) Scrape() (ScrapeResult, error) {
+	tiers := c.trackerTiers()
+	if len(tiers) == 0 || len(tiers[0]) == 0 {
+		return ScrapeResult{}, fmt.Errorf("torrent has no trackers")
+	}
+	tracker := tiers[0][0]
+
+	addr, err := url.Parse(tracker)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	switch addr.Scheme {
+	case "http", "https":
+		return scrapeHTTP(addr, c.InfoHash)
+	case "udp":
+		results, err := udpTrackerFor(addr.Host).Scrape(c.InfoHash)
+		if err != nil {
+			return ScrapeResult{}, err
+		}
+		return results[0], nil
+	default:
+		return ScrapeResult{}, fmt.Errorf("unsupported tracker URL %q", tracker)
+	}
+}
+
+// scrapeHTTP scrapes an HTTP tracker. By convention its scrape URL is the
+// announce URL with the last path segment "announce" replaced by "scrape".
+func scrapeHTTP(announce *url.URL, infoHash string) (ScrapeResult, error) {
+	result := ScrapeResult{}
+
+	dir, last := path.Split(announce.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return result, fmt.Errorf("tracker %s does not support scraping", announce)
+	}
+	addr := *announce
+	addr.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	values := addr.Query()
+	values.Add("info_hash", infoHash)
+	addr.RawQuery = values.Encode()
+
+	res, err := trackerClient.Get(addr.String())
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("tracker responded with status %d", res.StatusCode)
+	}
+
+	resp := struct {
+		Files map[string]struct {
+			Complete   int `bencode:"complete"`
+			Downloaded int `bencode:"downloaded"`
+			Incomplete int `bencode:"incomplete"`
+		} `bencode:"files"`
+	}{}
+	if err := bencode.Unmarshal(res.Body, &resp); err != nil {
+		return result, err
+	}
+	stats, ok := resp.Files[infoHash]
+	if !ok {
+		return result, fmt.Errorf("tracker has no statistics for the torrent")
+	}
+
+	result.Seeders = stats.Complete
+	result.Completed = stats.Downloaded
+	result.Leechers = stats.Incomplete
+	return result, nil
+}
+
+// left returns the number of bytes we report as left to download.
+func (c *Client) left() int {
+	// Until the metadata of a magnet link is known the length is 0, which the
+	// tracker would take to mean we are seeding.
+	total := c.Info.TotalLength()
+	if total == 0 {
+		return 1
+	}
+
+	left := total
+	for i := range c.PieceHashes {
+		if c.Have.Has(i) {
+			left -= c.pieceLength(i)
+		}
+	}
+	return left
+}
+
+// port returns the port we listen on for incoming peers.
+func (c *Client) port() int {
+	if c.Port == 0 {
+		return defaultPort
+	}
+	return c.Port
+}
+
+func peerRequestURL(rawURL string, infoHash string, peerID string, infoLength int, port int) (string, error) {
 	addr, err := url.Parse(rawURL)
 	if err != nil {
 		return "", err
@@ -87,8 +366,8 @@ func peerRequestURL(rawURL string, infoHash string, infoLength int) (string, err
 
 	values := addr.Query()
 	values.Add("info_hash", infoHash)
-	values.Add("peer_id", PeerID)
-	values.Add("port", "6881")
+	values.Add("peer_id", peerID)
+	values.Add("port", fmt.Sprint(port))
 	values.Add("uploaded", "0")
 	values.Add("downloaded", "0")
 	values.Add("left", fmt.Sprint(infoLength))
@@ -99,6 +378,20 @@ func peerRequestURL(rawURL string, infoHash string, infoLength int) (string, err
 	return addr.String(), nil
 }
 
+// uniquePeers returns peers without duplicate addresses, keeping the first
+// occurrence of each.
+func uniquePeers(peers []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, peer := range peers {
+		if !seen[peer] {
+			seen[peer] = true
+			unique = append(unique, peer)
+		}
+	}
+	return unique
+}
+
 func PrintPeers(peers []string) {
 	for _, peer := range peers {
 		fmt.Println(peer)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Extended message ID we assign to ut_pex.
+const extUtPex = 2
+
+// Peer exchange limits from BEP 11: a message is sent at most once a minute
+// and lists at most 50 added and 50 dropped peers.
+const (
+	pexInterval = time.Minute
+	maxPexPeers = 50
+)
+
+// Flags describing each added peer in a ut_pex message.
+const (
+	pexEncryption = 0x01 // prefers encrypted connections
+	pexSeed       = 0x02 // is a seed
+	pexUTP        = 0x04 // supports uTP
+	pexHolepunch  = 0x08 // supports ut_holepunch
+	pexReachable  = 0x10 // accepted an outgoing connection
+)
+
+func init() {
+	registerExtension(extension{name: "ut_pex", id: extUtPex, handle: handlePex, public: true})
+}
+
+// PexMessage is the bencoded payload of a ut_pex message. The peer lists are
+// in compact form, and each added peer has one byte of flags.
+type PexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// pexPeer is a peer announced in a ut_pex message.
+type pexPeer struct {
+	addr  string // ip_address:port of the peer
+	flags byte   // pex flags, 0 if the sender gave none
+}
+
+// parsePexMessage decodes a ut_pex payload into the peers added and the
+// addresses dropped since the sender's previous message.
+func parsePexMessage(payload []byte) ([]pexPeer, []string, error) {
+	msg := PexMessage{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload), &msg); err != nil {
+		return nil, nil, fmt.Errorf("invalid ut_pex message: %v", err)
+	}
+
+	added := []pexPeer{}
+	for i, addr := range parseCompactPeers(msg.Added) {
+		added = append(added, pexPeer{addr: addr, flags: flagAt(msg.AddedF, i)})
+	}
+	for i, addr := range parseCompactPeers6(msg.Added6) {
+		added = append(added, pexPeer{addr: addr, flags: flagAt(msg.Added6F, i)})
+	}
+	dropped := append(parseCompactPeers(msg.Dropped), parseCompactPeers6(msg.Dropped6)...)
+	return added, dropped, nil
+}
+
+// flagAt returns the flags of the i-th peer, or 0 if flags lists fewer.
+func flagAt(flags string, i int) byte {
+	if i < len(flags) {
+		return flags[i]
+	}
+	return 0
+}
+
+// handlePex passes the peers announced by a peer to its onPeers callback.
+func handlePex(pc *peerConn, payload []byte) error {
+	added, dropped, err := parsePexMessage(payload)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Peer %s exchanged %d added and %d dropped peers.\n", pc.addr, len(added), len(dropped))
+	if pc.onPeers != nil {
+		pc.onPeers(added, dropped)
+	}
+	return nil
+}
+
+// newPexMessage lists the peers in connected that were not in sent as added,
+// and those in sent that are no longer connected as dropped, up to
+// maxPexPeers of each. The peers listed are added to or removed from sent.
+// Every added peer is flagged reachable, since we completed a handshake with
+// it.
+func newPexMessage(connected []string, sent map[string]bool) PexMessage {
+	now := map[string]bool{}
+	added := []string{}
+	for _, addr := range connected {
+		now[addr] = true
+		if !sent[addr] && len(added) < maxPexPeers {
+			added = append(added, addr)
+			sent[addr] = true
+		}
+	}
+	dropped := []string{}
+	for addr := range sent {
+		if !now[addr] && len(dropped) < maxPexPeers {
+			dropped = append(dropped, addr)
+			delete(sent, addr)
+		}
+	}
+
+	msg := PexMessage{}
+	msg.Added, msg.Added6 = compactPeers(added)
+	msg.Dropped, msg.Dropped6 = compactPeers(dropped)
+	msg.AddedF = string(bytes.Repeat([]byte{pexReachable}, len(msg.Added)/6))
+	msg.Added6F = string(bytes.Repeat([]byte{pexReachable}, len(msg.Added6)/18))
+	return msg
+}
+
+// sendPex tells the peer which of the connected peers it has not heard about
+// from us, and which it has that are gone, if it supports ut_pex and no
+// message was sent to it in the last pexInterval. The peer itself is never
+// listed.
+func (pc *peerConn) sendPex(connected []string) error {
+	id := pc.ext.M["ut_pex"]
+	if id == 0 || time.Now().Before(pc.pexNext) {
+		return nil
+	}
+	pc.pexNext = time.Now().Add(pexInterval)
+
+	others := []string{}
+	for _, addr := range connected {
+		if addr != pc.addr {
+			others = append(others, addr)
+		}
+	}
+	if pc.pexSent == nil {
+		pc.pexSent = map[string]bool{}
+	}
+	msg := newPexMessage(others, pc.pexSent)
+	if msg.Added == "" && msg.Added6 == "" && msg.Dropped == "" && msg.Dropped6 == "" {
+		return nil
+	}
+	logger.Debug("Sending peer exchange to %s.\n", pc.addr)
+	if err := pc.refreshWriteDeadline(); err != nil {
+		return err
+	}
+	return sendExtendedMessage(pc.conn, id, msg)
+}
+
+// pexDue returns a channel that receives when the next ut_pex message to the
+// peer is due, or nil if none was sent to it yet.
+func (pc *peerConn) pexDue() <-chan time.Time {
+	if pc.pexNext.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(pc.pexNext))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// States of a piece in the picker.
+const (
+	pieceSkipped    = iota // not part of this download, or already saved
+	pieceWanted            // waiting to be picked
+	pieceInProgress        // picked and being downloaded from a peer
+	pieceVerified          // downloaded and waiting to be saved
+)
+
+// piecePicker decides which piece each peer downloads next. It counts how
+// many connected peers have each piece, from their bitfields and have
+// messages, and hands out the rarest wanted piece first so no piece stays
+// scarce in the swarm. Ties are broken at random so peers with the same
+// pieces do not all start on the same one. It is safe for concurrent use by
+// the peer workers.
+//
+// Once every remaining piece is in progress, the picker is in endgame mode:
+// a peer with nothing else to do is handed a piece that is already being
+// downloaded from another peer, so the download does not wait on the slowest
+// peer. Whichever copy arrives first is kept, and the finished channel of the
+// piece tells the other peers to cancel their requests.
+type piecePicker struct {
+	mu           sync.Mutex
+	availability []int           // number of connected peers with each piece
+	state        []int           // state of each piece
+	downloaders  []int           // number of peers downloading each piece
+	finished     []chan struct{} // closed when each piece is verified
+	wanted       int             // pieces waiting to be picked
+	remaining    int             // pieces not yet done
+	endgame      bool            // whether pieces are being picked twice
+	changed      chan struct{}   // closed when a piece becomes wanted again
+	rand         *rand.Rand      // source for tie-breaking
+}
+
+// newPiecePicker returns a picker for a torrent of pieces pieces that hands
+// out the pieces with the given indices.
+func newPiecePicker(pieces int, wanted []int) *piecePicker {
+	p := &piecePicker{
+		availability: make([]int, pieces),
+		state:        make([]int, pieces),
+		downloaders:  make([]int, pieces),
+		finished:     make([]chan struct{}, pieces),
+		changed:      make(chan struct{}),
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, i := range wanted {
+		if i >= 0 && i < pieces && p.state[i] != pieceWanted {
+			p.state[i] = pieceWanted
+			p.finished[i] = make(chan struct{})
+			p.wanted++
+			p.remaining++
+		}
+	}
+	return p
+}
+
+// AddPeer counts the pieces in the bitfield of a newly connected peer.
+func (p *piecePicker) AddPeer(has Bitfield) {
+	p.updatePeer(has, 1)
+}
+
+// RemovePeer stops counting the pieces of a disconnected peer. has must be the
+// peer's bitfield including any have messages already passed to Have.
+func (p *piecePicker) RemovePeer(has Bitfield) {
+	p.updatePeer(has, -1)
+}
+
+func (p *piecePicker) updatePeer(has Bitfield, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if has.Has(i) {
+			p.availability[i] += delta
+		}
+	}
+}
+
+// Have counts a piece announced by a peer in a have message.
+func (p *piecePicker) Have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Interesting reports whether has contains any piece that is still being
+// looked for, so we should tell the peer we are interested.
+func (p *piecePicker) Interesting(has Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, state := range p.state {
+		if (state == pieceWanted || state == pieceInProgress) && has.Has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick returns the rarest wanted piece that is in has and marks it in
+// progress. In endgame mode it returns the piece in has with the fewest
+// peers downloading it instead. It returns false if the peer has none of the
+// pieces it could download.
+func (p *piecePicker) Pick(has Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var picked int
+	if p.wanted > 0 {
+		picked = p.pickBy(has, pieceWanted, p.availability)
+	} else {
+		picked = p.pickBy(has, pieceInProgress, p.downloaders)
+		if picked >= 0 && !p.endgame {
+			p.endgame = true
+			logger.Info("Entering endgame mode with %d pieces remaining.\n", p.remaining)
+		}
+	}
+	if picked < 0 {
+		return 0, false
+	}
+
+	p.take(picked)
+	return picked, true
+}
+
+// PickFrom returns the first of the given pieces that is wanted and in has,
+// and marks it in progress. It is used for pieces the peer singled out, such
+// as suggested pieces or those we may download while choked.
+func (p *piecePicker) PickFrom(indices []int, has Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, i := range indices {
+		if i >= 0 && i < len(p.state) && p.state[i] == pieceWanted && has.Has(i) {
+			p.take(i)
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// take marks the piece at index as being downloaded by one more peer.
+func (p *piecePicker) take(index int) {
+	if p.state[index] == pieceWanted {
+		p.state[index] = pieceInProgress
+		p.wanted--
+		if p.wanted == 0 {
+			// Idle peers can now help with the pieces in progress.
+			p.signal()
+		}
+	}
+	p.downloaders[index]++
+}
+
+// pickBy returns the piece in has in the given state with the lowest count,
+// or -1 if there is none.
+func (p *piecePicker) pickBy(has Bitfield, state int, count []int) int {
+	picked, ties := -1, 0
+	for i := range p.state {
+		if p.state[i] != state || !has.Has(i) {
+			continue
+		}
+		switch {
+		case picked < 0 || count[i] < count[picked]:
+			picked, ties = i, 1
+		case count[i] == count[picked]:
+			// Keep each of the equally rare pieces with equal probability.
+			ties++
+			if p.rand.Intn(ties) == 0 {
+				picked = i
+			}
+		}
+	}
+	return picked
+}
+
+// Finished returns a channel that is closed once the piece at index has been
+// downloaded and verified.
+func (p *piecePicker) Finished(index int) <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.finished[index]
+}
+
+// Abort records that a peer stopped downloading a piece. Once no peer is
+// downloading it, a piece that is not done yet is put back among the wanted
+// pieces.
+func (p *piecePicker) Abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.downloaders[index] > 0 {
+		p.downloaders[index]--
+	}
+	if p.state[index] != pieceInProgress || p.downloaders[index] > 0 {
+		return
+	}
+	p.state[index] = pieceWanted
+	p.wanted++
+	p.signal()
+}
+
+// signal wakes up the peers waiting for something to download.
+func (p *piecePicker) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Verified records that a peer downloaded the piece at index and it passed
+// its hash check, and tells any other peers downloading it to stop. It
+// returns false if another peer's copy was verified first, in which case this
+// copy should be dropped.
+func (p *piecePicker) Verified(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.downloaders[index] > 0 {
+		p.downloaders[index]--
+	}
+	if p.state[index] != pieceInProgress {
+		return false
+	}
+	p.state[index] = pieceVerified
+	close(p.finished[index])
+	return true
+}
+
+// Done marks a verified piece as saved.
+func (p *piecePicker) Done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state[index] != pieceVerified {
+		return
+	}
+	p.state[index] = pieceSkipped
+	p.remaining--
+}
+
+// Remaining returns the number of pieces that are not done yet.
+func (p *piecePicker) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.remaining
+}
+
+// Changed returns a channel that is closed the next time a piece is put back
+// by Abort or endgame mode begins. A peer that has nothing to pick waits on
+// it before trying again; it must get the channel before calling Pick so no
+// change is missed.
+func (p *piecePicker) Changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.changed
+}
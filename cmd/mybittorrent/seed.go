@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Largest block a peer may request from us.
+const maxRequestLength = 128 * 1024
+
+// How long an idle incoming connection is kept open. Peers send a keep-alive
+// at least every two minutes.
+const seedIdleTimeout = 3 * time.Minute
+
+// Seed serves the torrent data in the files at dataPath to incoming peers on
+// c.Port. It only returns if the listener fails.
+func (c *Client) Seed(dataPath string) error {
+	root, files := c.outputFiles(dataPath)
+	storage, err := openFileStorage(root, files)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return c.SeedFrom(storage)
+}
+
+// SeedFrom serves the pieces in storage that pass their hash check to
+// incoming peers on c.Port. It only returns if the listener fails.
+func (c *Client) SeedFrom(storage Storage) error {
+	c.Have = c.verifyPieces(storage)
+	logger.Info("Have %d/%d pieces of %s.\n", c.Have.Count(), len(c.PieceHashes), c.Info.Name)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", c.port()))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	logger.Info("Listening for peers on %s.\n", ln.Addr())
+
+	// Let the trackers know where to find us. Seeding still works for peers
+	// that know our address if none of them answers.
+	if err := c.FindPeers(); err != nil {
+		logger.Warning("Could not announce to trackers: %v\n", err)
+	}
+
+	return c.serve(ln, storage)
+}
+
+// verifyPieces reads every piece from storage and returns a bitfield of the
+// pieces that match their hash. Pieces lying only in files the storage just
+// created are skipped, as they cannot hold any data yet.
+func (c *Client) verifyPieces(storage Storage) Bitfield {
+	have := newBitfield(len(c.PieceHashes))
+	r, resuming := storage.(resumable)
+	for i, hash := range c.PieceHashes {
+		if resuming && !r.HadData(int64(i*c.Info.PieceLength), int64(c.pieceLength(i))) {
+			continue
+		}
+		piece, err := c.readPiece(storage, i)
+		if err != nil {
+			logger.Debug("Could not read piece %d: %v\n", i, err)
+			continue
+		}
+		if pieceIsValid(hash, piece) {
+			have.Set(i)
+		}
+	}
+	return have
+}
+
+// serve accepts incoming peers on ln and serves them blocks read from storage
+// until ln is closed. A choker decides which of them are unchoked. We only
+// upload to incoming peers, so it ranks them by upload rate even while we
+// are missing pieces.
+func (c *Client) serve(ln net.Listener, storage Storage) error {
+	ch := newChoker(uploadSlots, func() bool { return true })
+	done := make(chan struct{})
+	defer close(done)
+	go ch.Run(done)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			addr := conn.RemoteAddr()
+			if err := c.servePeer(conn, storage, ch); err != nil && err != io.EOF {
+				logger.Warning("Stopped serving %s: %v\n", addr, err)
+			}
+		}()
+	}
+}
+
+// seedPeer is an incoming connection we upload to. Its choke state is changed
+// by the choker while servePeer answers the peer's messages. Writes to conn
+// are serialized by writeMu, and the fields after mu are guarded by mu, which
+// is never held during I/O so the choker can always query the peer.
+type seedPeer struct {
+	conn        net.Conn
+	writeMu     sync.Mutex
+	mu          sync.Mutex
+	state       peerState
+	fast        bool              // whether the Fast Extension is enabled
+	allowedFast map[int]bool      // pieces served even while the peer is choked
+	ext         ExtendedHandshake // the peer's extended handshake, once received
+	uploaded    int64             // bytes of blocks sent
+}
+
+// Interested reports whether the peer wants our pieces.
+func (p *seedPeer) Interested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state.peerInterested
+}
+
+// Transferred returns the bytes received from and sent to the peer. We never
+// download from incoming peers.
+func (p *seedPeer) Transferred() (int64, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return 0, p.uploaded
+}
+
+// Choked reports whether the peer is choked.
+func (p *seedPeer) Choked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state.amChoking
+}
+
+// SetChoked chokes or unchokes the peer.
+func (p *seedPeer) SetChoked(choked bool) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	if choked == p.Choked() {
+		return nil
+	}
+	msgType := msgUnchoke
+	if choked {
+		msgType = msgChoke
+	}
+	logger.Debug("Setting peer %s choked: %v.\n", p.conn.RemoteAddr(), choked)
+	if err := sendMessage(p.conn, Message{Header: MessageHeader{Type: msgType}}); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.state.amChoking = choked
+	p.mu.Unlock()
+	return nil
+}
+
+// servePeer answers the handshake of an incoming peer, tells it which pieces
+// we have, and answers its requests while ch keeps it unchoked, until it disconnects.
+func (c *Client) servePeer(conn net.Conn, storage Storage, ch *choker) error {
+	defer conn.Close()
+	logger.Info("Incoming connection from %s.\n", conn.RemoteAddr())
+
+	if err := conn.SetDeadline(time.Now().Add(peerTimeout)); err != nil {
+		return err
+	}
+	peer, err := readHandshake(conn)
+	if err != nil {
+		return err
+	}
+	if peer.InfoHash != c.InfoHash {
+		return fmt.Errorf("peer asked for unknown torrent %x", peer.InfoHash)
+	}
+	if peer.PeerID == c.peerID() {
+		return errSelfConnection
+	}
+	logger.Debug("Peer %s is running %s.\n", conn.RemoteAddr(), identifyClient(peer.PeerID))
+	if _, err := conn.Write(newHandshakeMessage(c.InfoHash, c.peerID())); err != nil {
+		return err
+	}
+
+	sp := &seedPeer{conn: conn, state: newPeerState(), fast: peer.Fast, allowedFast: map[int]bool{}}
+	if err := c.sendHave(sp); err != nil {
+		return err
+	}
+	if peer.Extended {
+		// Incoming peers are not part of a swarm, so there is nothing to
+		// exchange with them.
+		ours := ourExtendedHandshake(len(c.RawInfo), true)
+		if err := sendExtendedMessage(conn, extHandshake, ours); err != nil {
+			return err
+		}
+	}
+	ch.Add(sp)
+	defer ch.Remove(sp)
+
+	for {
+		if err := conn.SetDeadline(time.Now().Add(seedIdleTimeout)); err != nil {
+			return err
+		}
+		raw, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		msg, err := decodeMessage(raw)
+		if err != nil {
+			return err
+		}
+
+		sp.mu.Lock()
+		sp.state.update(msg)
+		sp.mu.Unlock()
+
+		switch m := msg.(type) {
+		case interestedMsg, notInterestedMsg:
+			ch.Update()
+		case requestMsg:
+			err = c.serveSeedRequest(sp, storage, m.blockRequest)
+		case extendedMsg:
+			err = c.serveExtended(sp, m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendHave tells a new peer which pieces we have. With the Fast Extension a
+// complete or empty bitfield is replaced by have all or have none, and the
+// peer is told the pieces of its allowed fast set that we have.
+func (c *Client) sendHave(sp *seedPeer) error {
+	have := Message{
+		Header:  MessageHeader{Type: msgBitfield},
+		Payload: c.Have,
+	}
+	if sp.fast {
+		switch c.Have.Count() {
+		case len(c.PieceHashes):
+			have = Message{Header: MessageHeader{Type: msgHaveAll}}
+		case 0:
+			have = Message{Header: MessageHeader{Type: msgHaveNone}}
+		}
+	}
+	if err := sendMessage(sp.conn, have); err != nil {
+		return err
+	}
+	if !sp.fast {
+		return nil
+	}
+
+	addr, ok := sp.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	for _, index := range allowedFastSet(addr.IP, c.InfoHash, len(c.PieceHashes), allowedFastCount) {
+		if !c.Have.Has(index) {
+			continue
+		}
+		allowed := Message{
+			Header:  MessageHeader{Type: msgAllowedFast},
+			Payload: binary.BigEndian.AppendUint32(nil, uint32(index)),
+		}
+		if err := sendMessage(sp.conn, allowed); err != nil {
+			return err
+		}
+		sp.allowedFast[index] = true
+	}
+	return nil
+}
+
+// serveSeedRequest answers a request from sp unless it is choked and the
+// piece is not in its allowed fast set. Without the Fast Extension such a
+// request is ignored and the peer is expected to ask again once unchoked;
+// with it, the request is rejected, as are requests for pieces we lack.
+func (c *Client) serveSeedRequest(sp *seedPeer, storage Storage, r blockRequest) error {
+	// Holding writeMu keeps the choke state from changing until the block
+	// is sent.
+	sp.writeMu.Lock()
+	defer sp.writeMu.Unlock()
+	choked := sp.Choked() && !sp.allowedFast[r.index]
+
+	if sp.fast && (!c.Have.Has(r.index) || choked) {
+		logger.Debug("Rejecting request from peer %s for piece %d.\n", sp.conn.RemoteAddr(), r.index)
+		return sendBlockMessage(sp.conn, msgRejected, r.index, r.offset, r.length)
+	}
+	if choked {
+		logger.Debug("Ignoring request from choked peer %s.\n", sp.conn.RemoteAddr())
+		return nil
+	}
+	if err := c.serveRequest(sp.conn, storage, r); err != nil {
+		return err
+	}
+
+	sp.mu.Lock()
+	sp.uploaded += int64(r.length)
+	sp.mu.Unlock()
+	return nil
+}
+
+// serveExtended records the extended handshake of sp and answers its
+// ut_metadata requests.
+func (c *Client) serveExtended(sp *seedPeer, m extendedMsg) error {
+	switch m.id {
+	case extHandshake:
+		h, err := parseExtendedHandshake(m.payload)
+		if err != nil {
+			return err
+		}
+		sp.mu.Lock()
+		sp.ext = h
+		sp.mu.Unlock()
+	case extUtMetadata:
+		sp.mu.Lock()
+		ext := sp.ext
+		sp.mu.Unlock()
+		if !ext.Supports("ut_metadata") {
+			return fmt.Errorf("ut_metadata request before the extended handshake")
+		}
+		sp.writeMu.Lock()
+		defer sp.writeMu.Unlock()
+		return serveMetadata(sp.conn, c.RawInfo, ext.M["ut_metadata"], m.payload)
+	default:
+		logger.Debug("Ignoring extended message %d from %s.\n", m.id, sp.conn.RemoteAddr())
+	}
+	return nil
+}
+
+// serveRequest reads the requested block from storage and sends it to the
+// peer in a piece message.
+func (c *Client) serveRequest(conn io.Writer, storage Storage, r blockRequest) error {
+	if !c.Have.Has(r.index) {
+		return fmt.Errorf("peer requested piece %d, which we do not have", r.index)
+	}
+	if r.length <= 0 || r.length > maxRequestLength {
+		return fmt.Errorf("invalid request length %d", r.length)
+	}
+
+	block, err := c.readBlock(storage, r.index, r.offset, r.length)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Sending piece %d, offset %d, length %d.\n", r.index, r.offset, r.length)
+
+	payload := binary.BigEndian.AppendUint32(nil, uint32(r.index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(r.offset))
+	return sendMessage(conn, Message{
+		Header:  MessageHeader{Type: msgPiece},
+		Payload: append(payload, block...),
+	})
+}
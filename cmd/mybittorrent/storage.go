@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Storage holds the data of a torrent. The data is addressed as one contiguous
+// range of bytes, so piece i starts at i * PieceLength and a piece may span
+// several files of a multi-file torrent.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// Storage backends that can be chosen by name.
+const (
+	storageFile   = "file"   // plain reads and writes to the output files
+	storageMmap   = "mmap"   // output files mapped into memory
+	storageMemory = "memory" // in memory only, nothing is written to disk
+)
+
+// NewStorage creates the storage backend named backend for a download of the
+// torrent to outputPath.
+func (c *Client) NewStorage(backend string, outputPath string) (Storage, error) {
+	root, files := c.outputFiles(outputPath)
+
+	switch backend {
+	case storageFile, "":
+		storage, err := createFileStorage(root, files, c.Preallocate)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	case storageMmap:
+		return createMmapStorage(root, files)
+	case storageMemory:
+		return NewMemoryStorage(c.Info.TotalLength()), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// syncer is implemented by storage backends that buffer writes.
+type syncer interface {
+	Sync() error
+}
+
+// resumable is implemented by storage backends that can hold data from an
+// earlier download.
+type resumable interface {
+	// HadData reports whether any of length bytes at offset off may hold
+	// such data.
+	HadData(off, length int64) bool
+}
+
+// hadData reports whether any of the files covering length bytes of torrent
+// data at offset off existed, according to existed.
+func hadData(files []fileEntry, existed []bool, off, length int64) bool {
+	start := int64(0)
+	for i, f := range files {
+		end := start + int64(f.Length)
+		if existed[i] && start < off+length && off < end {
+			return true
+		}
+		start = end
+	}
+	return false
+}
+
+// readPiece reads the piece at index from storage.
+func (c *Client) readPiece(storage Storage, index int) ([]byte, error) {
+	return c.readBlock(storage, index, 0, c.pieceLength(index))
+}
+
+// readBlock reads length bytes at offset within the piece at index.
+func (c *Client) readBlock(storage Storage, index, offset, length int) ([]byte, error) {
+	if offset < 0 || length < 0 || offset+length > c.pieceLength(index) {
+		return nil, fmt.Errorf("block at offset %d, length %d is outside piece %d", offset, length, index)
+	}
+	block := make([]byte, length)
+	if _, err := storage.ReadAt(block, int64(index*c.Info.PieceLength+offset)); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// writePiece writes the piece at index to storage.
+func (c *Client) writePiece(storage Storage, index int, data []byte) error {
+	if len(data) != c.pieceLength(index) {
+		return fmt.Errorf("piece %d has length %d, expected %d", index, len(data), c.pieceLength(index))
+	}
+	_, err := storage.WriteAt(data, int64(index*c.Info.PieceLength))
+	return err
+}
+
+// syncStorage commits written data to disk if the backend buffers it.
+func syncStorage(storage Storage) error {
+	if s, ok := storage.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// eachFile splits the part of the torrent data that p covers, starting at
+// offset off, into the parts that fall into each file. It calls do for every
+// part with the index of the file, the slice of p, and the offset within the
+// file. It returns io.EOF if p runs past the end of the last file.
+func eachFile(files []fileEntry, p []byte, off int64, do func(i int, p []byte, off int64) (int, error)) (int, error) {
+	total := 0
+	for i, f := range files {
+		if len(p) == 0 {
+			break
+		}
+		end := int64(f.Offset + f.Length)
+		if off >= end || f.Length == 0 {
+			continue
+		}
+
+		n := int64(len(p))
+		if off+n > end {
+			n = end - off
+		}
+		done, err := do(i, p[:n], off-int64(f.Offset))
+		total += done
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		off += n
+	}
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
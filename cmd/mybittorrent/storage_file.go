@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Size of the zero-filled chunks written when fully preallocating a file.
+const preallocChunkLength = 1024 * 1024
+
+// fileStorage keeps the torrent data in the files of the torrent, using
+// ordinary reads and writes.
+type fileStorage struct {
+	files   []fileEntry // files in the order of the torrent data
+	handles []*os.File  // open file for each entry
+	existed []bool      // whether each file held data before it was opened
+}
+
+// openFileStorage opens the existing files of the torrent under root for
+// reading.
+func openFileStorage(root string, files []fileEntry) (*fileStorage, error) {
+	s := &fileStorage{files: files}
+	for _, f := range files {
+		h, err := os.Open(filepath.Join(root, f.Path))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, h)
+		s.existed = append(s.existed, true)
+	}
+	return s, nil
+}
+
+// createFileStorage opens the files of the torrent under root for reading and
+// writing, creating them and their directories as needed, and sizes each file
+// to its final length. Existing data is kept so an interrupted download can
+// be resumed. The files are sparse unless full is set, in which case the
+// missing space is filled with zeros up front.
+func createFileStorage(root string, files []fileEntry, full bool) (*fileStorage, error) {
+	s := &fileStorage{files: files}
+	for _, f := range files {
+		path := filepath.Join(root, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.existed = append(s.existed, fileHasData(path))
+		h, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, h)
+
+		if err := preallocate(h, int64(f.Length), full); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// fileHasData reports whether the file at path exists and is not empty.
+func fileHasData(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.Size() > 0
+}
+
+// preallocate grows or shrinks the file to length bytes.
+func preallocate(f *os.File, length int64, full bool) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	if size == length {
+		return nil
+	}
+	if size > length || !full {
+		return f.Truncate(length)
+	}
+
+	logger.Debug("Preallocating %d bytes for %s...\n", length-size, f.Name())
+	zeros := make([]byte, preallocChunkLength)
+	for size < length {
+		n := int64(len(zeros))
+		if length-size < n {
+			n = length - size
+		}
+		if _, err := f.WriteAt(zeros[:n], size); err != nil {
+			return err
+		}
+		size += n
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes of torrent data starting at offset off, crossing
+// file boundaries as needed.
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return eachFile(s.files, p, off, func(i int, p []byte, off int64) (int, error) {
+		return s.handles[i].ReadAt(p, off)
+	})
+}
+
+// WriteAt writes p to the torrent data at offset off, crossing file
+// boundaries as needed.
+func (s *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return eachFile(s.files, p, off, func(i int, p []byte, off int64) (int, error) {
+		return s.handles[i].WriteAt(p, off)
+	})
+}
+
+// HadData reports whether any of the files covering length bytes at offset
+// off held data before the storage was opened.
+func (s *fileStorage) HadData(off, length int64) bool {
+	return hadData(s.files, s.existed, off, length)
+}
+
+// Sync commits the written data to disk.
+func (s *fileStorage) Sync() error {
+	for _, h := range s.handles {
+		if err := h.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every open file.
+func (s *fileStorage) Close() error {
+	var err error
+	for _, h := range s.handles {
+		if closeErr := h.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
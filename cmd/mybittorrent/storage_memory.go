@@ -0,0 +1,48 @@
+package main
+
+import "io"
+
+// MemoryStorage keeps the torrent data in memory.
+type MemoryStorage struct {
+	data []byte
+}
+
+// NewMemoryStorage returns an empty in-memory storage for length bytes of
+// torrent data.
+func NewMemoryStorage(length int) *MemoryStorage {
+	return &MemoryStorage{data: make([]byte, length)}
+}
+
+// ReadAt copies the data at offset off into p.
+func (s *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt copies p into the data at offset off.
+func (s *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(s.data)) {
+		return 0, io.ErrShortWrite
+	}
+	n := copy(s.data[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// Bytes returns the torrent data. It is not a copy.
+func (s *MemoryStorage) Bytes() []byte {
+	return s.data
+}
+
+// Close does nothing, the data stays available through Bytes.
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,114 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// mmapStorage keeps the torrent data in the files of the torrent, mapped into
+// memory.
+type mmapStorage struct {
+	files   []fileEntry // files in the order of the torrent data
+	handles []*os.File  // open file for each entry
+	maps    [][]byte    // mapped contents of each file, nil for empty files
+	existed []bool      // whether each file held data before it was opened
+}
+
+// createMmapStorage opens the files of the torrent under root like
+// createFileStorage, then maps each of them into memory.
+func createMmapStorage(root string, files []fileEntry) (Storage, error) {
+	s := &mmapStorage{files: files}
+	for _, f := range files {
+		path := filepath.Join(root, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.existed = append(s.existed, fileHasData(path))
+		h, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, h)
+
+		// Files are always sparse, the pages are allocated as they are
+		// written.
+		if err := preallocate(h, int64(f.Length), false); err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		var data []byte
+		if f.Length > 0 {
+			data, err = syscall.Mmap(int(h.Fd()), 0, f.Length,
+				syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		s.maps = append(s.maps, data)
+	}
+	return s, nil
+}
+
+// ReadAt copies torrent data starting at offset off into p.
+func (s *mmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	if s.maps == nil {
+		return 0, os.ErrClosed
+	}
+	return eachFile(s.files, p, off, func(i int, p []byte, off int64) (int, error) {
+		return copy(p, s.maps[i][off:]), nil
+	})
+}
+
+// WriteAt copies p into the torrent data at offset off.
+func (s *mmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	if s.maps == nil {
+		return 0, os.ErrClosed
+	}
+	return eachFile(s.files, p, off, func(i int, p []byte, off int64) (int, error) {
+		return copy(s.maps[i][off:], p), nil
+	})
+}
+
+// HadData reports whether any of the files covering length bytes at offset
+// off held data before the storage was opened.
+func (s *mmapStorage) HadData(off, length int64) bool {
+	return hadData(s.files, s.existed, off, length)
+}
+
+// Sync flushes the mapped pages of every file to disk.
+func (s *mmapStorage) Sync() error {
+	for _, h := range s.handles {
+		if err := h.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close unmaps and closes every file.
+func (s *mmapStorage) Close() error {
+	var err error
+	for _, data := range s.maps {
+		if data == nil {
+			continue
+		}
+		if unmapErr := syscall.Munmap(data); unmapErr != nil {
+			err = unmapErr
+		}
+	}
+	for _, h := range s.handles {
+		if closeErr := h.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	s.maps = nil
+	s.handles = nil
+	return err
+}
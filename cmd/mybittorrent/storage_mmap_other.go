@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// createMmapStorage is only available on Unix systems.
+func createMmapStorage(root string, files []fileEntry) (Storage, error) {
+	return nil, fmt.Errorf("mmap storage is not supported on this system")
+}
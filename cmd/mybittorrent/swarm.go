@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Most peers a download is connected to at once.
+const maxPeerConns = 30
+
+// swarm keeps track of the peers of a download. Addresses come from the
+// trackers and from peer exchange, are queued in the order they arrive, and
+// are connected to at most once while the download runs.
+type swarm struct {
+	mu        sync.Mutex
+	seen      map[string]bool   // every address queued, being dialed or connected
+	queue     []string          // addresses waiting for a connection, oldest first
+	source    map[string]string // peer each queued address was learned from, empty for trackers
+	dialing   map[string]bool   // addresses being dialed, before the handshake completes
+	connected map[string]bool   // addresses with a running connection
+	idle      map[string]bool   // connected peers with none of the remaining pieces
+	added     chan struct{}     // signalled when the queue grows
+	idled     chan struct{}     // signalled when a peer becomes idle
+}
+
+// newSwarm returns a swarm with addrs queued.
+func newSwarm(addrs []string) *swarm {
+	s := &swarm{
+		seen:      map[string]bool{},
+		source:    map[string]string{},
+		dialing:   map[string]bool{},
+		connected: map[string]bool{},
+		idle:      map[string]bool{},
+		added:     make(chan struct{}, 1),
+		idled:     make(chan struct{}, 1),
+	}
+	s.Add("", addrs)
+	return s
+}
+
+// Add queues the addresses not seen before and returns how many there were.
+// from is the peer that reported them, or empty if they come from a tracker.
+func (s *swarm) Add(from string, addrs []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, addr := range addrs {
+		if s.seen[addr] {
+			continue
+		}
+		s.seen[addr] = true
+		s.queue = append(s.queue, addr)
+		if from != "" {
+			s.source[addr] = from
+		}
+		n++
+	}
+	if n > 0 {
+		select {
+		case s.added <- struct{}{}:
+		default:
+		}
+	}
+	return n
+}
+
+// Drop removes addresses the peer from reports as gone from the queue. Only
+// those learned from that same peer are removed, so one peer cannot make us
+// forget what the trackers and other peers told us. They may be added again
+// later. Peers being dialed or connected are left alone.
+func (s *swarm) Drop(from string, addrs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := map[string]bool{}
+	for _, addr := range addrs {
+		if s.source[addr] == from && s.seen[addr] && !s.dialing[addr] && !s.connected[addr] {
+			dropped[addr] = true
+			delete(s.seen, addr)
+			delete(s.source, addr)
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+	queue := s.queue[:0]
+	for _, addr := range s.queue {
+		if !dropped[addr] {
+			queue = append(queue, addr)
+		}
+	}
+	s.queue = queue
+}
+
+// Next takes the oldest queued address and records it as being dialed, unless
+// maxPeerConns are already dialed or connected or the queue is empty.
+func (s *swarm) Next() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.dialing)+len(s.connected) >= maxPeerConns || len(s.queue) == 0 {
+		return "", false
+	}
+	addr := s.queue[0]
+	s.queue = s.queue[1:]
+	delete(s.source, addr)
+	s.dialing[addr] = true
+	return addr, true
+}
+
+// Handshaken records that the peer at addr, returned by Next, completed the
+// handshake.
+func (s *swarm) Handshaken(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dialing[addr] {
+		delete(s.dialing, addr)
+		s.connected[addr] = true
+	}
+}
+
+// Disconnected records that the connection to addr has ended, or could not
+// be made.
+func (s *swarm) Disconnected(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.dialing, addr)
+	delete(s.connected, addr)
+	delete(s.idle, addr)
+}
+
+// SetIdle records whether the connected peer at addr has told us its pieces
+// and has none that we still need.
+func (s *swarm) SetIdle(addr string, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.connected[addr] || s.idle[addr] == idle {
+		return
+	}
+	if !idle {
+		delete(s.idle, addr)
+		return
+	}
+	s.idle[addr] = true
+	select {
+	case s.idled <- struct{}{}:
+	default:
+	}
+}
+
+// Stalled reports whether every peer is connected and idle, and none is
+// queued, so no peer can supply the remaining pieces.
+func (s *swarm) Stalled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.queue) == 0 && len(s.dialing) == 0 &&
+		len(s.connected) > 0 && len(s.idle) == len(s.connected)
+}
+
+// Active returns the number of peers being dialed or connected.
+func (s *swarm) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.dialing) + len(s.connected)
+}
+
+// Connected returns the addresses of the peers that completed the handshake,
+// in order.
+func (s *swarm) Connected() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]string, 0, len(s.connected))
+	for addr := range s.connected {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Added returns a channel that receives when new addresses are queued.
+func (s *swarm) Added() <-chan struct{} {
+	return s.added
+}
+
+// Idled returns a channel that receives when a peer becomes idle.
+func (s *swarm) Idled() <-chan struct{} {
+	return s.idled
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15) constants
+const (
+	udpProtocolID = 0x41727101980 // magic constant sent with connect requests
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionIDLifetime = time.Minute       // connection IDs expire after a minute
+	udpBaseTimeout          = 15 * time.Second  // first timeout, doubled on each retry
+	udpMaxRetries           = 8                 // retransmissions before giving up
+	udpMaxPacketSize        = 8 + 6*1024 + 1024 // room for a large peer list
+)
+
+// UDPTracker talks to a tracker using the UDP tracker protocol. It caches the
+// connection ID the tracker hands out for as long as it is valid.
+type UDPTracker struct {
+	Addr        string        // host:port of the tracker
+	BaseTimeout time.Duration // timeout of the first try, doubled for each retry
+	MaxRetries  int           // number of retransmissions before giving up
+	Timeout     time.Duration // limit for a whole announce or scrape, 0 means none
+
+	mu       sync.Mutex
+	connID   uint64    // connection ID from the last connect response
+	connTime time.Time // when connID was received
+	key      uint32    // random key identifying us across IP changes
+}
+
+// ScrapeResult holds the swarm statistics a tracker reports for a torrent.
+type ScrapeResult struct {
+	Seeders   int // peers with the whole torrent
+	Completed int // number of completed downloads
+	Leechers  int // peers still downloading
+}
+
+var (
+	udpTrackersMu sync.Mutex
+	udpTrackers   = map[string]*UDPTracker{} // trackers by address
+)
+
+// udpTrackerFor returns the tracker at addr, reusing the one from an earlier
+// announce so its connection ID can be reused.
+func udpTrackerFor(addr string) *UDPTracker {
+	udpTrackersMu.Lock()
+	defer udpTrackersMu.Unlock()
+
+	t, ok := udpTrackers[addr]
+	if !ok {
+		t = NewUDPTracker(addr)
+		udpTrackers[addr] = t
+	}
+	return t
+}
+
+// NewUDPTracker returns a tracker client for addr using the timeouts from the
+// specification, but giving up after trackerTimeout rather than retrying for
+// hours.
+func NewUDPTracker(addr string) *UDPTracker {
+	return &UDPTracker{
+		Addr:        addr,
+		BaseTimeout: udpBaseTimeout,
+		MaxRetries:  udpMaxRetries,
+		Timeout:     trackerTimeout,
+		key:         randomUint32(),
+	}
+}
+
+// Announce announces infoHash to the tracker as peerID and returns the peers
+// it knows, in the same compact form an HTTP tracker uses.
+func (t *UDPTracker) Announce(infoHash string, peerID string, left int, port int) (GetPeersResponse, error) {
+	peerResp := GetPeersResponse{}
+
+	conn, err := net.Dial("udp", t.Addr)
+	if err != nil {
+		return peerResp, err
+	}
+	defer conn.Close()
+
+	resp, err := t.request(conn, t.deadline(), udpActionAnnounce, func() []byte {
+		body := make([]byte, 82)
+		copy(body[0:20], infoHash)
+		copy(body[20:40], peerID)
+		binary.BigEndian.PutUint64(body[40:48], 0)            // downloaded
+		binary.BigEndian.PutUint64(body[48:56], uint64(left)) // left
+		binary.BigEndian.PutUint64(body[56:64], 0)            // uploaded
+		binary.BigEndian.PutUint32(body[64:68], 0)            // event: none
+		binary.BigEndian.PutUint32(body[68:72], 0)            // IP address: sender's
+		binary.BigEndian.PutUint32(body[72:76], t.key)
+		binary.BigEndian.PutUint32(body[76:80], 0xffffffff) // num_want: default
+		binary.BigEndian.PutUint16(body[80:82], uint16(port))
+		return body
+	})
+	if err != nil {
+		return peerResp, err
+	}
+	if len(resp) < 20 {
+		return peerResp, fmt.Errorf("announce response too short: %d bytes", len(resp))
+	}
+
+	peerResp.Interval = int(binary.BigEndian.Uint32(resp[8:12]))
+	peerResp.Incomplete = int(binary.BigEndian.Uint32(resp[12:16]))
+	peerResp.Complete = int(binary.BigEndian.Uint32(resp[16:20]))
+	peers := resp[20:]
+	peerResp.Peers = string(peers[:len(peers)-len(peers)%6])
+
+	return peerResp, nil
+}
+
+// Scrape asks the tracker for the statistics of each torrent in infoHashes.
+func (t *UDPTracker) Scrape(infoHashes ...string) ([]ScrapeResult, error) {
+	conn, err := net.Dial("udp", t.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := t.request(conn, t.deadline(), udpActionScrape, func() []byte {
+		body := []byte{}
+		for _, infoHash := range infoHashes {
+			body = append(body, infoHash...)
+		}
+		return body
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short: %d bytes", len(resp))
+	}
+
+	results := []ScrapeResult{}
+	for i := range infoHashes {
+		entry := resp[8+12*i:]
+		results = append(results, ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		})
+	}
+	return results, nil
+}
+
+// deadline returns when a request starting now has to give up, or the zero
+// time if it may retry for as long as the specification allows.
+func (t *UDPTracker) deadline() time.Time {
+	if t.Timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(t.Timeout)
+}
+
+// request sends a request with the given action and body, connecting first
+// if there is no valid connection ID, and returns the tracker's response.
+// Both exchanges give up at deadline unless it is zero.
+func (t *UDPTracker) request(conn net.Conn, deadline time.Time, action uint32, body func() []byte) ([]byte, error) {
+	return t.exchange(conn, deadline, action, func() ([]byte, error) {
+		connID, err := t.connectionID(conn, deadline)
+		if err != nil {
+			return nil, err
+		}
+		return append(udpHeader(connID, action), body()...), nil
+	})
+}
+
+// connectionID returns the cached connection ID, or gets a new one from the
+// tracker if it has expired.
+func (t *UDPTracker) connectionID(conn net.Conn, deadline time.Time) (uint64, error) {
+	t.mu.Lock()
+	connID, connTime := t.connID, t.connTime
+	t.mu.Unlock()
+	if !connTime.IsZero() && time.Since(connTime) < udpConnectionIDLifetime {
+		return connID, nil
+	}
+
+	logger.Debug("Connecting to UDP tracker %s...\n", t.Addr)
+	resp, err := t.exchange(conn, deadline, udpActionConnect, func() ([]byte, error) {
+		return udpHeader(udpProtocolID, udpActionConnect), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 16 {
+		return 0, fmt.Errorf("connect response too short: %d bytes", len(resp))
+	}
+	connID = binary.BigEndian.Uint64(resp[8:16])
+
+	t.mu.Lock()
+	t.connID, t.connTime = connID, time.Now()
+	t.mu.Unlock()
+
+	return connID, nil
+}
+
+// exchange sends the packet returned by build and waits for the response with
+// the same transaction ID. If none arrives in time, it builds and sends the
+// packet again after waiting BaseTimeout * 2^n for the nth try, until
+// deadline if it is not zero.
+func (t *UDPTracker) exchange(conn net.Conn, deadline time.Time, action uint32, build func() ([]byte, error)) ([]byte, error) {
+	for n := 0; n <= t.MaxRetries; n++ {
+		wait := t.BaseTimeout << n
+		if !deadline.IsZero() && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		if wait <= 0 {
+			break
+		}
+
+		packet, err := build()
+		if err != nil {
+			return nil, err
+		}
+		transactionID := binary.BigEndian.Uint32(packet[12:16])
+
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return nil, err
+		}
+
+		resp, err := readUDPResponse(conn, action, transactionID)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			logger.Debug("UDP tracker %s timed out, retrying (%d/%d)...\n", t.Addr, n+1, t.MaxRetries)
+			continue
+		}
+		return resp, err
+	}
+	return nil, fmt.Errorf("UDP tracker %s did not respond", t.Addr)
+}
+
+// readUDPResponse reads packets until one matches transactionID, and checks
+// that it answers the expected action.
+func readUDPResponse(conn net.Conn, action, transactionID uint32) ([]byte, error) {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			logger.Debug("Ignoring unexpected %d byte packet from UDP tracker.\n", n)
+			continue
+		}
+
+		resp := buf[:n]
+		switch respAction := binary.BigEndian.Uint32(resp[0:4]); respAction {
+		case action:
+			return resp, nil
+		case udpActionError:
+			return nil, fmt.Errorf("tracker error: %s", resp[8:])
+		default:
+			return nil, fmt.Errorf("expected tracker action %d, received %d", action, respAction)
+		}
+	}
+}
+
+// udpHeader builds the header shared by every request: the connection ID, the
+// action and a random transaction ID.
+func udpHeader(connID uint64, action uint32) []byte {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header[0:8], connID)
+	binary.BigEndian.PutUint32(header[8:12], action)
+	binary.BigEndian.PutUint32(header[12:16], randomUint32())
+	return header
+}
+
+func randomUint32() uint32 {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		logger.Error("Error generating random number: %v", err)
+	}
+	return binary.BigEndian.Uint32(b)
+}